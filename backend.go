@@ -0,0 +1,363 @@
+package leaf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Names of the backends that can be used with the watcher.
+const (
+	BackendFsnotify = "fsnotify"
+	BackendPoll     = "poll"
+)
+
+// ErrEventOverflow is reported by a backend when events are
+// lost because too many of them occurred at once.
+var ErrEventOverflow = fsnotify.ErrEventOverflow
+
+// DefaultPollInterval is the interval after which the poll
+// backend checks for changes when none is specified.
+var DefaultPollInterval = time.Second
+
+// Event is a file system event reported by a backend.
+type Event struct {
+	Name string
+	Op   Op
+}
+
+// Backend reports the changes in the directories added to it.
+// Directories are watched non-recursively, i.e., only the
+// changes to the direct children of the directory are
+// reported.
+type Backend interface {
+	// Add starts watching the directory.
+	Add(path string) error
+
+	// Remove stops watching the directory.
+	Remove(path string) error
+
+	// Events is the stream of file system events.
+	Events() <-chan Event
+
+	// Errors is the stream of errors that occur while watching.
+	Errors() <-chan error
+
+	// Close stops watching all the directories.
+	Close() error
+}
+
+// NewBackend creates the backend from its name. The interval
+// is used only by the poll backend.
+func NewBackend(name string, interval time.Duration) (Backend, error) {
+	switch name {
+	case "", BackendFsnotify:
+		return NewFsnotifyBackend()
+
+	case BackendPoll:
+		return NewPollBackend(interval), nil
+
+	default:
+		return nil, fmt.Errorf("invalid backend '%s'", name)
+	}
+}
+
+// FsnotifyBackend uses the file system notifications from the
+// operating system (inotify, kqueue etc.) to report changes.
+type FsnotifyBackend struct {
+	notifier *fsnotify.Watcher
+
+	events chan Event
+	done   chan bool
+}
+
+// NewFsnotifyBackend creates a new fsnotify backend.
+func NewFsnotifyBackend() (*FsnotifyBackend, error) {
+	notifier, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	b := &FsnotifyBackend{
+		notifier: notifier,
+		events:   make(chan Event),
+		done:     make(chan bool),
+	}
+
+	go b.forwardEvents()
+
+	return b, nil
+}
+
+// Add starts watching the directory.
+func (b *FsnotifyBackend) Add(path string) error {
+	return b.notifier.Add(path)
+}
+
+// Remove stops watching the directory.
+func (b *FsnotifyBackend) Remove(path string) error {
+	return b.notifier.Remove(path)
+}
+
+// Events is the stream of file system events.
+func (b *FsnotifyBackend) Events() <-chan Event {
+	return b.events
+}
+
+// Errors is the stream of errors that occur while watching.
+func (b *FsnotifyBackend) Errors() <-chan error {
+	return b.notifier.Errors
+}
+
+// Close stops watching all the directories.
+func (b *FsnotifyBackend) Close() error {
+	close(b.done)
+	return b.notifier.Close()
+}
+
+// forwardEvents converts the fsnotify events into events
+// until the backend is closed.
+func (b *FsnotifyBackend) forwardEvents() {
+	for {
+		select {
+		case event, ok := <-b.notifier.Events:
+			if !ok {
+				return
+			}
+
+			select {
+			case b.events <- Event{
+				Name: event.Name,
+				Op:   opFromFsnotify(event.Op),
+			}:
+			case <-b.done:
+				return
+			}
+
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// opFromFsnotify converts the fsnotify operation into Op.
+func opFromFsnotify(fop fsnotify.Op) Op {
+	var op Op
+
+	if fop&fsnotify.Create == fsnotify.Create {
+		op |= OpCreate
+	}
+
+	if fop&fsnotify.Write == fsnotify.Write {
+		op |= OpWrite
+	}
+
+	if fop&fsnotify.Remove == fsnotify.Remove {
+		op |= OpRemove
+	}
+
+	if fop&fsnotify.Rename == fsnotify.Rename {
+		op |= OpRename
+	}
+
+	if fop&fsnotify.Chmod == fsnotify.Chmod {
+		op |= OpChmod
+	}
+
+	return op
+}
+
+// PollBackend checks the directories for changes by comparing
+// the modification time, size and mode of the files after
+// every interval. It works where file system notifications
+// are not available, like network file systems or mounted
+// volumes in containers.
+//
+// Renames can't be detected by polling and are reported as a
+// remove of the old path and a create of the new one.
+type PollBackend struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	dirs map[string]map[string]fileStat
+
+	events chan Event
+	errors chan error
+	done   chan bool
+}
+
+// fileStat is the state of the file as seen by the poller.
+type fileStat struct {
+	modTime time.Time
+	size    int64
+	mode    os.FileMode
+}
+
+// NewPollBackend creates a new poll backend which checks for
+// changes after every interval.
+func NewPollBackend(interval time.Duration) *PollBackend {
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+
+	b := &PollBackend{
+		interval: interval,
+		dirs:     map[string]map[string]fileStat{},
+		events:   make(chan Event),
+		errors:   make(chan error),
+		done:     make(chan bool),
+	}
+
+	go b.poll()
+
+	return b
+}
+
+// Add starts watching the directory.
+func (b *PollBackend) Add(path string) error {
+	path = filepath.Clean(path)
+
+	stats, err := readDirStats(path)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.dirs[path]; !ok {
+		b.dirs[path] = stats
+	}
+
+	return nil
+}
+
+// Remove stops watching the directory.
+func (b *PollBackend) Remove(path string) error {
+	path = filepath.Clean(path)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.dirs[path]; !ok {
+		return fmt.Errorf(
+			"can't remove non-existent watch for: %s", path)
+	}
+
+	delete(b.dirs, path)
+	return nil
+}
+
+// Events is the stream of file system events.
+func (b *PollBackend) Events() <-chan Event {
+	return b.events
+}
+
+// Errors is the stream of errors that occur while watching.
+func (b *PollBackend) Errors() <-chan error {
+	return b.errors
+}
+
+// Close stops watching all the directories.
+func (b *PollBackend) Close() error {
+	close(b.done)
+	return nil
+}
+
+// poll checks the directories for changes after every
+// interval until the backend is closed.
+func (b *PollBackend) poll() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, event := range b.scan() {
+				select {
+				case b.events <- event:
+				case <-b.done:
+					return
+				}
+			}
+
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// scan compares the current state of the directories with the
+// last seen state and returns the changes.
+func (b *PollBackend) scan() []Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	events := []Event{}
+
+	for dir, oldStats := range b.dirs {
+		newStats, err := readDirStats(dir)
+		if err != nil {
+			// The directory is gone. Its removal is reported
+			// by the parent directory (if watched).
+			delete(b.dirs, dir)
+			continue
+		}
+
+		for name, stat := range newStats {
+			oldStat, ok := oldStats[name]
+			path := filepath.Join(dir, name)
+
+			switch {
+			case !ok:
+				events = append(events, Event{Name: path, Op: OpCreate})
+
+			case !stat.modTime.Equal(oldStat.modTime) || stat.size != oldStat.size:
+				if !stat.mode.IsDir() {
+					events = append(events, Event{Name: path, Op: OpWrite})
+				}
+
+			case stat.mode != oldStat.mode:
+				events = append(events, Event{Name: path, Op: OpChmod})
+			}
+		}
+
+		for name := range oldStats {
+			if _, ok := newStats[name]; !ok {
+				events = append(events, Event{
+					Name: filepath.Join(dir, name),
+					Op:   OpRemove,
+				})
+			}
+		}
+
+		b.dirs[dir] = newStats
+	}
+
+	return events
+}
+
+// readDirStats reads the state of all the files in the
+// directory.
+func readDirStats(dir string) (map[string]fileStat, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make(map[string]fileStat, len(infos))
+	for _, info := range infos {
+		stats[info.Name()] = fileStat{
+			modTime: info.ModTime(),
+			size:    info.Size(),
+			mode:    info.Mode(),
+		}
+	}
+
+	return stats, nil
+}
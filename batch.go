@@ -0,0 +1,185 @@
+package leaf
+
+import (
+	"context"
+	"time"
+)
+
+// Change is a file that changed along-with all the operations
+// done on it.
+type Change struct {
+	File string
+	Op   Op
+}
+
+// ChangeSet has the unique files changed in a batch or the
+// error that occurred during watching.
+type ChangeSet struct {
+	Changes []Change
+	Err     error
+}
+
+// Files returns the paths of the changed files.
+func (cs ChangeSet) Files() []string {
+	files := make([]string, 0, len(cs.Changes))
+	for _, c := range cs.Changes {
+		files = append(files, c.File)
+	}
+
+	return files
+}
+
+// Filter returns the change set with only the changes that
+// have any of the given operations.
+func (cs ChangeSet) Filter(op Op) ChangeSet {
+	filtered := ChangeSet{Err: cs.Err}
+	for _, c := range cs.Changes {
+		if c.Op.Has(op) {
+			filtered.Changes = append(filtered.Changes, c)
+		}
+	}
+
+	return filtered
+}
+
+// Batcher collects the watch results into change sets so that
+// a bunch of files changed together are handled at once.
+//
+// Changes are debounced on the trailing edge, i.e., a batch
+// is streamed once no change occurs for the window duration.
+// Continuous changes can delay the batch for at most the max
+// wait duration.
+type Batcher struct {
+	// Window is the quiet period after the last change after
+	// which the batch is streamed.
+	Window time.Duration
+
+	// MaxWait is the maximum duration, starting at the first
+	// change, for which a batch can be delayed. There's no
+	// limit if it's zero.
+	MaxWait time.Duration
+}
+
+// NewBatcher creates a new batcher.
+func NewBatcher(batcher Batcher) *Batcher {
+	return &Batcher{
+		Window:  batcher.Window,
+		MaxWait: batcher.MaxWait,
+	}
+}
+
+// Batch reads the watch results and streams the change sets.
+// Errors are streamed as soon as they occur. The stream is
+// closed when the results are exhausted or the context is
+// canceled.
+func (b *Batcher) Batch(ctx context.Context, results <-chan WatchResult) <-chan ChangeSet {
+	sets := make(chan ChangeSet)
+	go b.startBatching(ctx, results, sets)
+	return sets
+}
+
+// startBatching collects the results into change sets until
+// the results are exhausted or the context is canceled.
+func (b *Batcher) startBatching(ctx context.Context, results <-chan WatchResult, sets chan<- ChangeSet) {
+	defer close(sets)
+
+	var (
+		pending = []Change{}
+		index   = map[string]int{}
+
+		quiet    = newStoppedTimer()
+		maxWait  = newStoppedTimer()
+		waiting  = false
+		stopWait = func() {
+			stopTimer(quiet)
+			stopTimer(maxWait)
+			waiting = false
+		}
+	)
+	defer stopWait()
+
+	send := func(cs ChangeSet) bool {
+		select {
+		case sets <- cs:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	flush := func() bool {
+		stopWait()
+		if len(pending) == 0 {
+			return true
+		}
+
+		cs := ChangeSet{Changes: pending}
+		pending = []Change{}
+		index = map[string]int{}
+		return send(cs)
+	}
+
+	for {
+		select {
+		case wr, ok := <-results:
+			if !ok {
+				flush()
+				return
+			}
+
+			if wr.Err != nil {
+				if !send(ChangeSet{Err: wr.Err}) {
+					return
+				}
+				continue
+			}
+
+			if i, ok := index[wr.File]; ok {
+				pending[i].Op |= wr.Op
+			} else {
+				index[wr.File] = len(pending)
+				pending = append(pending, Change{File: wr.File, Op: wr.Op})
+			}
+
+			// Restart the quiet period on every change.
+			stopTimer(quiet)
+			quiet.Reset(b.Window)
+
+			if !waiting && b.MaxWait > 0 {
+				maxWait.Reset(b.MaxWait)
+			}
+			waiting = true
+
+		case <-quiet.C:
+			if !flush() {
+				return
+			}
+
+		case <-maxWait.C:
+			if !flush() {
+				return
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// newStoppedTimer creates a timer that is not running.
+func newStoppedTimer() *time.Timer {
+	t := time.NewTimer(time.Hour)
+	stopTimer(t)
+	return t
+}
+
+// stopTimer stops the timer and drains its channel so that
+// it can be safely reset.
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
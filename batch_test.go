@@ -0,0 +1,108 @@
+package leaf
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBatcherQuietWindow(t *testing.T) {
+	const window = 100 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results := make(chan WatchResult)
+	sets := NewBatcher(Batcher{Window: window}).Batch(ctx, results)
+
+	results <- WatchResult{File: "a.go", Op: OpCreate}
+	time.Sleep(window / 2)
+	results <- WatchResult{File: "b.go", Op: OpWrite}
+	time.Sleep(window / 2)
+	results <- WatchResult{File: "a.go", Op: OpWrite}
+	last := time.Now()
+
+	cs := <-sets
+	if elapsed := time.Since(last); elapsed < window {
+		t.Errorf("batch streamed %v after the last change, want at least %v", elapsed, window)
+	}
+
+	want := []Change{
+		{File: "a.go", Op: OpCreate | OpWrite},
+		{File: "b.go", Op: OpWrite},
+	}
+	if !reflect.DeepEqual(cs.Changes, want) {
+		t.Errorf("got changes %v, want %v", cs.Changes, want)
+	}
+
+	// Errors are streamed right away.
+	results <- WatchResult{File: "c.go", Op: OpWrite}
+	results <- WatchResult{Err: ErrEventOverflow}
+
+	if cs := <-sets; cs.Err != ErrEventOverflow || len(cs.Changes) != 0 {
+		t.Errorf("got %+v, want the error", cs)
+	}
+
+	if cs := <-sets; len(cs.Changes) != 1 || cs.Changes[0].File != "c.go" {
+		t.Errorf("got %+v, want the change to c.go", cs)
+	}
+
+	// Pending changes are streamed when the results end.
+	results <- WatchResult{File: "d.go", Op: OpRemove}
+	close(results)
+
+	if cs := <-sets; len(cs.Changes) != 1 || cs.Changes[0].File != "d.go" {
+		t.Errorf("got %+v, want the change to d.go", cs)
+	}
+
+	if _, ok := <-sets; ok {
+		t.Error("change sets not closed after the results end")
+	}
+}
+
+func TestBatcherMaxWait(t *testing.T) {
+	const (
+		window  = 100 * time.Millisecond
+		maxWait = 300 * time.Millisecond
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results := make(chan WatchResult)
+	sets := NewBatcher(Batcher{Window: window, MaxWait: maxWait}).Batch(ctx, results)
+
+	// Changes keep occurring within the window until the batch
+	// is streamed.
+	start := time.Now()
+	ticker := time.NewTicker(window / 4)
+	defer ticker.Stop()
+
+	var cs ChangeSet
+	for sent := false; !sent; {
+		select {
+		case cs = <-sets:
+			sent = true
+
+		case <-ticker.C:
+			if time.Since(start) > 3*maxWait {
+				t.Fatalf("no batch streamed in %v with a max wait of %v", time.Since(start), maxWait)
+			}
+
+			select {
+			case results <- WatchResult{File: "a.go", Op: OpWrite}:
+			case cs = <-sets:
+				sent = true
+			}
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed < maxWait {
+		t.Errorf("batch streamed after %v, want at least %v", elapsed, maxWait)
+	}
+
+	if len(cs.Changes) != 1 || cs.Changes[0].File != "a.go" {
+		t.Errorf("got %+v, want the change to a.go", cs)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -21,7 +23,11 @@ var (
 	confPath  string
 	debugEnv  bool
 	once      bool
+	poll      bool
 	exitOnErr bool
+	dryRun    bool
+	speed     float64
+	maxGap    time.Duration
 
 	conf leaf.Config
 )
@@ -41,8 +47,8 @@ can be excluded.`,
 		initialiseLogger()
 	},
 
-	PreRun: func(*cobra.Command, []string) {
-		ferr, rerr := setupConfig()
+	PreRun: func(cmd *cobra.Command, _ []string) {
+		ferr, rerr := setupConfig(cmd)
 		if rerr != nil {
 			log.Fatalln(rerr)
 		} else if ferr != nil {
@@ -51,7 +57,13 @@ can be excluded.`,
 	},
 
 	Run: func(*cobra.Command, []string) {
-		log.Infof("watching '%s'", conf.Root)
+		for _, root := range conf.Root {
+			log.Infof("watching '%s'", root)
+		}
+
+		for _, file := range conf.Files {
+			log.Infof("watching file '%s'", file)
+		}
 
 		if err := runEngine(&conf); err != nil {
 			log.Fatalln(err)
@@ -75,6 +87,35 @@ Prints the build information for the leaf commnd line.`,
 	},
 }
 
+var replayCmd = &cobra.Command{
+	Use:   "replay <recording>",
+	Short: "replays a recorded watch session",
+	Long: `
+Replays the changes recorded with --record through the filters,
+the delay and the commands from the config, with the same timing
+as they were recorded, to reproduce the behaviour of a session.
+Use --max-gap (a bit longer than the delay) to skip the long
+pauses of the recording while still running the commands for
+the same batches of changes.`,
+
+	Args: cobra.ExactArgs(1),
+
+	PreRun: func(cmd *cobra.Command, _ []string) {
+		ferr, rerr := setupConfig(cmd)
+		if rerr != nil {
+			log.Fatalln(rerr)
+		} else if ferr != nil {
+			log.Warnf("config file not read: %v", ferr)
+		}
+	},
+
+	Run: func(_ *cobra.Command, args []string) {
+		if err := runReplay(&conf, args[0]); err != nil {
+			log.Fatalln(err)
+		}
+	},
+}
+
 func init() {
 	initializeFlags()
 
@@ -83,6 +124,7 @@ func init() {
 	}
 
 	rootCmd.AddCommand(versionCmd)
+	rootCmd.AddCommand(replayCmd)
 }
 
 // Execute starts the command line tool.
@@ -119,18 +161,82 @@ func initializeFlags() {
 		&once, "once", "o", false,
 		"run once and exit (no reload)")
 
-	rootCmd.Flags().StringP(
-		"root", "r", leaf.CWD,
-		"root directory to watch")
+	rootCmd.Flags().StringSliceP(
+		"root", "r", []string{leaf.CWD},
+		"root directories to watch")
+
+	rootCmd.Flags().Bool(
+		"follow-symlinks", false,
+		"watch directories that symbolic links point to")
+
+	rootCmd.Flags().StringSlice(
+		"files", []string{},
+		"files to watch in addition to the root directories")
 
 	rootCmd.Flags().StringSliceP(
 		"exclude", "e", leaf.DefaultExcludePaths,
 		"paths to exclude from watching")
 
+	rootCmd.Flags().Bool(
+		"gitignore", false,
+		"ignore paths listed in .gitignore files")
+
 	rootCmd.Flags().StringSliceP(
 		"filters", "f", []string{},
 		"filters to apply to watch")
 
+	rootCmd.Flags().String(
+		"filter-handler", leaf.FilterHandlerStandard,
+		"how filters are evaluated (standard: excludes win, ordered: last match wins)")
+
+	rootCmd.Flags().StringSlice(
+		"events", leaf.DefaultEvents,
+		"events (create, write, remove, rename, chmod, repo) that trigger commands")
+
+	rootCmd.Flags().Bool(
+		"git", false,
+		"report git operations (checkout, commit, ...) as a single repo event")
+
+	rootCmd.Flags().BoolVar(
+		&poll, "poll", false,
+		"poll for changes instead of using file system notifications")
+
+	rootCmd.Flags().Duration(
+		"poll-interval", leaf.DefaultPollInterval,
+		"interval after which files are polled for changes")
+
+	rootCmd.Flags().Bool(
+		"poll-on-limit", false,
+		"poll directories that exceed the watch limit instead of exiting")
+
+	rootCmd.Flags().Bool(
+		"rescan-on-overflow", true,
+		"scan directories again when events overflow")
+
+	rootCmd.Flags().Int(
+		"buffer-size", leaf.DefaultSubscriberBuffer,
+		"number of events buffered while commands are running")
+
+	rootCmd.Flags().String(
+		"overflow-policy", "coalesce",
+		"policy when the event buffer is full (block, drop-newest, drop-oldest, coalesce)")
+
+	rootCmd.Flags().Bool(
+		"hash", false,
+		"ignore writes that don't change the content of files")
+
+	rootCmd.Flags().Int(
+		"hash-cache-size", leaf.DefaultHashCacheSize,
+		"number of files for which content hash is remembered")
+
+	rootCmd.Flags().Bool(
+		"since-last-run", false,
+		"run commands at start only if files changed since the last run")
+
+	rootCmd.Flags().String(
+		"state-dir", leaf.DefaultStateDir,
+		"directory to store the state between runs")
+
 	rootCmd.Flags().StringSliceP(
 		"exec", "x", []string{},
 		"exec commands on file change")
@@ -141,18 +247,70 @@ func initializeFlags() {
 
 	rootCmd.Flags().DurationP(
 		"delay", "d", 500*time.Millisecond,
-		"delay after which commands are run on file change")
+		"delay after the last file change after which commands are run")
+
+	rootCmd.Flags().Duration(
+		"max-delay", 5*time.Second,
+		"maximum delay after the first file change after which commands are run")
+
+	rootCmd.Flags().Int(
+		"storm-threshold", 1000,
+		"events per storm interval above which commands are paused (0 to disable)")
+
+	rootCmd.Flags().Duration(
+		"storm-interval", leaf.DefaultStormInterval,
+		"interval over which the rate of events is measured")
+
+	rootCmd.Flags().Duration(
+		"storm-cooldown", leaf.DefaultStormCooldown,
+		"duration of calm after which paused commands resume")
+
+	rootCmd.Flags().String(
+		"record", "",
+		"record events, filter decisions and triggers to the file")
+
+	replayCmd.Flags().BoolVar(
+		&dryRun, "dry-run", false,
+		"log the commands instead of running them")
+
+	replayCmd.Flags().Float64Var(
+		&speed, "speed", 1,
+		"factor by which the replay is faster than the recording")
+
+	replayCmd.Flags().DurationVar(
+		&maxGap, "max-gap", 0,
+		"longest pause between two changes (0 for no limit)")
 }
 
 // bindFlagsToConfig binds the flags with viper config file.
 func bindFlagsToConfig() error {
 	keyFlagMap := map[string]string{
-		"root":        "root",
-		"exclude":     "exclude",
-		"filters":     "filters",
-		"exec":        "exec",
-		"exit_on_err": "exit-on-err",
-		"delay":       "delay",
+		"root":               "root",
+		"follow_symlinks":    "follow-symlinks",
+		"files":              "files",
+		"exclude":            "exclude",
+		"gitignore":          "gitignore",
+		"filters":            "filters",
+		"filter_handler":     "filter-handler",
+		"events":             "events",
+		"git":                "git",
+		"poll_interval":      "poll-interval",
+		"poll_on_limit":      "poll-on-limit",
+		"rescan_on_overflow": "rescan-on-overflow",
+		"buffer_size":        "buffer-size",
+		"overflow_policy":    "overflow-policy",
+		"hash":               "hash",
+		"hash_cache_size":    "hash-cache-size",
+		"since_last_run":     "since-last-run",
+		"state_dir":          "state-dir",
+		"exec":               "exec",
+		"exit_on_err":        "exit-on-err",
+		"delay":              "delay",
+		"max_delay":          "max-delay",
+		"storm_threshold":    "storm-threshold",
+		"storm_interval":     "storm-interval",
+		"storm_cooldown":     "storm-cooldown",
+		"record":             "record",
 	}
 
 	for key, flag := range keyFlagMap {
@@ -166,8 +324,8 @@ func bindFlagsToConfig() error {
 }
 
 // setupConfig reads and unmarshals the config file into
-// the `conf` variable.
-func setupConfig() (fileErr, readErr error) {
+// the `conf` variable for the command.
+func setupConfig(cmd *cobra.Command) (fileErr, readErr error) {
 	if confPath != "" {
 		viper.SetConfigFile(confPath)
 	} else {
@@ -208,9 +366,236 @@ func setupConfig() (fileErr, readErr error) {
 		conf.Exclude = finalExcludes
 	}
 
+	// Paths in the config file are relative to the directory
+	// of the file, while the ones from the flags are relative
+	// to the working directory. Filters are relative to the
+	// roots in turn.
+	confDir := filepath.Dir(viper.ConfigFileUsed())
+	fromFile := func(key, flag string) bool {
+		return confFileErr == nil && viper.InConfig(key) &&
+			!cmd.Flags().Changed(flag)
+	}
+
+	rootsFromFile := fromFile("root", "root")
+	for i, root := range conf.Root {
+		if rootsFromFile && !filepath.IsAbs(root) {
+			root = filepath.Join(confDir, root)
+		}
+
+		absRoot, err := filepath.Abs(root)
+		if err != nil {
+			return confFileErr, fmt.Errorf("unable to resolve root: %v", err)
+		}
+
+		conf.Root[i] = absRoot
+	}
+
+	if len(conf.Root) == 0 {
+		conf.Root = []string{leaf.CWD}
+	}
+
+	// Paths relative to the home directory are left as they
+	// are for the watcher to resolve.
+	relativeToConf := func(path string) string {
+		if path == "" || filepath.IsAbs(path) || strings.HasPrefix(path, "~") {
+			return path
+		}
+
+		return filepath.Join(confDir, path)
+	}
+
+	if fromFile("files", "files") {
+		for i, file := range conf.Files {
+			conf.Files[i] = relativeToConf(file)
+		}
+	}
+
+	if fromFile("state_dir", "state-dir") {
+		conf.StateDir = relativeToConf(conf.StateDir)
+	}
+
+	if fromFile("record", "record") {
+		conf.Record = relativeToConf(conf.Record)
+	}
+
+	if poll {
+		conf.Backend = leaf.BackendPoll
+	}
+
+	if len(conf.Events) == 0 {
+		conf.Events = leaf.DefaultEvents
+	}
+
 	return confFileErr, nil
 }
 
+// logWatchLimitError logs the diagnostics for the error that
+// occurs when the watch limit is reached.
+func logWatchLimitError(err *leaf.WatchLimitError) {
+	log.Errorf("tried to watch %d directories, only %d could be watched",
+		err.Dirs, err.Watched)
+
+	if err.MaxUserWatches > 0 {
+		log.Errorf("kernel limits: fs.inotify.max_user_watches = %d, fs.inotify.max_user_instances = %d",
+			err.MaxUserWatches, err.MaxUserInstances)
+	}
+
+	for _, s := range err.Largest {
+		log.Errorf("large directory: '%s' (%d directories)", s.Path, s.Dirs)
+	}
+
+	log.Error("exclude the large directories, raise the limit or use --poll-on-limit")
+}
+
+// createFilters creates the filters from the config relative
+// to the base directory.
+func createFilters(conf *leaf.Config, base string) *leaf.FilterCollection {
+	handler, err := leaf.ParseFilterHandler(conf.FilterHandler)
+	if err != nil {
+		log.Fatalf("error creating filters: %v", err)
+	}
+
+	fc, err := leaf.NewFCFromPatternsRelativeTo(
+		conf.Filters,
+		base,
+		leaf.StandardFilterMatcher,
+		handler)
+	if err != nil {
+		log.Fatalf("error creating filters: %v", err)
+	}
+
+	return fc
+}
+
+// createWatcher creates the watcher from the config. The
+// recorder, if any, records the events of the watcher.
+func createWatcher(conf *leaf.Config, recorder *leaf.Recorder) *leaf.Watcher {
+	// Filters are relative to each root, while the common
+	// ones are relative to the first root.
+	fc := createFilters(conf, conf.Root[0])
+
+	backend, err := leaf.NewBackend(conf.Backend, conf.PollInterval)
+	if err != nil {
+		log.Fatalf("error creating backend: %v", err)
+	}
+
+	overflowPolicy, err := leaf.ParseOverflowPolicy(conf.OverflowPolicy)
+	if err != nil {
+		log.Fatalf("error parsing overflow policy: %v", err)
+	}
+
+	// The state directory is excluded so that saving the
+	// state doesn't trigger the commands.
+	exclude := conf.Exclude
+	if conf.SinceLastRun {
+		stateDir, err := filepath.Abs(conf.StateDir)
+		if err != nil {
+			log.Fatalf("error resolving state directory: %v", err)
+		}
+
+		exclude = append(append([]string{}, exclude...), stateDir)
+	}
+
+	roots := []leaf.WatchRoot{}
+	for _, root := range conf.Root {
+		roots = append(roots, leaf.WatchRoot{
+			Path:    root,
+			Filters: createFilters(conf, root),
+		})
+	}
+
+	// Rules in .leafignore come later so that they can
+	// override the ones in .gitignore.
+	ignoreFiles := []string{}
+	if conf.Gitignore {
+		ignoreFiles = append(ignoreFiles, leaf.GitIgnoreFile)
+	}
+	ignoreFiles = append(ignoreFiles, leaf.LeafIgnoreFile)
+
+	watcher, err := leaf.NewWatcherWithOptions(leaf.WatcherOptions{
+		Roots:            roots,
+		Files:            conf.Files,
+		FollowSymlinks:   conf.FollowSymlinks,
+		Exclude:          exclude,
+		Filters:          fc,
+		IgnoreFiles:      ignoreFiles,
+		HashContents:     conf.Hash,
+		HashCacheSize:    conf.HashCacheSize,
+		PollOnWatchLimit: conf.PollOnLimit,
+		PollInterval:     conf.PollInterval,
+		RescanOnOverflow: conf.RescanOnOverflow,
+		Git:              conf.Git,
+		Recorder:         recorder,
+
+		SubscriberBuffer:     conf.BufferSize,
+		SlowSubscriberPolicy: overflowPolicy,
+
+		Backend: backend,
+	})
+	if err != nil {
+		if limitErr, ok := err.(*leaf.WatchLimitError); ok {
+			logWatchLimitError(limitErr)
+			err = limitErr.Err
+		}
+
+		log.Fatalf("error creating watcher: %v", err)
+	}
+
+	if polled := watcher.PolledDirs(); len(polled) > 0 {
+		log.Warnf("watch limit reached: polling %d directories", len(polled))
+	}
+
+	return watcher
+}
+
+// hasChangedSinceLastRun compares the files with the snapshot
+// of the last run and tells if any of the files changed. The
+// snapshot is replaced with the current one.
+func hasChangedSinceLastRun(watcher *leaf.Watcher, snapshotPath string, hash bool, events leaf.Op) bool {
+	prev, err := leaf.LoadSnapshot(snapshotPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("cannot read snapshot of last run: %v", err)
+		}
+
+		prev = &leaf.Snapshot{Files: map[string]leaf.FileState{}}
+	}
+
+	cs, current, err := watcher.ChangesSince(prev, hash)
+	if err != nil {
+		log.Fatalf("error comparing with last run: %v", err)
+	}
+
+	if err := current.Save(snapshotPath); err != nil {
+		log.Warnf("cannot save snapshot: %v", err)
+	}
+
+	cs = cs.Filter(events)
+	for _, c := range cs.Changes {
+		log.Infof("file '%s' changed since last run (%s)", c.File, c.Op)
+	}
+
+	if len(cs.Changes) == 0 {
+		log.Info("no changes since last run")
+		return false
+	}
+
+	return true
+}
+
+// saveSnapshot saves the state of the watched files so that
+// the changes can be found in the next run.
+func saveSnapshot(watcher *leaf.Watcher, snapshotPath string, hash bool) {
+	s, err := watcher.Snapshot(hash)
+	if err == nil {
+		err = s.Save(snapshotPath)
+	}
+
+	if err != nil {
+		log.Warnf("cannot save snapshot: %v", err)
+	}
+}
+
 // runEngine runs the watcher and executes the commands from
 // the config on file change.
 func runEngine(conf *leaf.Config) error {
@@ -218,11 +603,69 @@ func runEngine(conf *leaf.Config) error {
 		log.Infof("closing: signal received: %s", s.String())
 	})
 
-	commander := leaf.NewCommander(leaf.Commander{
+	events, err := leaf.ParseOps(conf.Events)
+	if err != nil {
+		log.Fatalf("error parsing events: %v", err)
+	}
+
+	var recorder *leaf.Recorder
+	if conf.Record != "" {
+		f, err := os.Create(conf.Record)
+		if err != nil {
+			log.Fatalf("error creating recording: %v", err)
+		}
+		defer f.Close() // nolint:errcheck
+
+		recorder = leaf.NewRecorder(f)
+		log.Infof("recording events to '%s'", conf.Record)
+	}
+
+	watcher := createWatcher(conf, recorder)
+
+	snapshotPath := filepath.Join(conf.StateDir, leaf.SnapshotFile)
+	runFirst := true
+	if conf.SinceLastRun {
+		runFirst = hasChangedSinceLastRun(watcher, snapshotPath, conf.Hash, events)
+	}
+
+	p := &pipeline{
+		conf:      conf,
+		commander: newCommander(conf, false),
+		events:    events,
+		recorder:  recorder,
+		dropped:   watcher.Dropped,
+	}
+
+	var results <-chan leaf.WatchResult
+	if !once {
+		results = watcher.Watch(ctx)
+	}
+	p.run(ctx, results, runFirst)
+
+	if conf.SinceLastRun {
+		saveSnapshot(watcher, snapshotPath, conf.Hash)
+	}
+
+	log.Infoln("shutdown successfully")
+	return nil
+}
+
+// newCommander creates the commander for the commands from
+// the config. The commands are only logged on a dry run.
+func newCommander(conf *leaf.Config, dryRun bool) *leaf.Commander {
+	onStart := func(cmd *leaf.Command) {
+		log.Infof("running: %s", cmd.String())
+	}
+
+	if dryRun {
+		onStart = func(cmd *leaf.Command) {
+			log.Infof("would run: %s", cmd.String())
+		}
+	}
+
+	return leaf.NewCommander(leaf.Commander{
 		Commands: conf.Exec,
-		OnStart: func(cmd *leaf.Command) {
-			log.Infof("running: %s", cmd.String())
-		},
+		OnStart:  onStart,
 		OnError: func(err error) {
 			log.Errorln(err)
 		},
@@ -230,46 +673,177 @@ func runEngine(conf *leaf.Config) error {
 			log.Info("commands executed")
 		},
 		ExitOnError: conf.ExitOnErr,
+		DryRun:      dryRun,
 	})
+}
 
-	fc, err := leaf.NewFCFromPatterns(
-		conf.Filters,
-		leaf.StandardFilterMatcher,
-		leaf.StandardFilterHandler)
-	if err != nil {
-		log.Fatalf("error creating filters: %v", err)
-	}
+// pipeline batches the watch results and runs the commands
+// for the changes, as per the config.
+type pipeline struct {
+	conf      *leaf.Config
+	commander *leaf.Commander
+	events    leaf.Op
+	recorder  *leaf.Recorder
+
+	// dropped returns the number of results dropped by the
+	// watcher, if any.
+	dropped func() uint64
+}
 
-	watcher, err := leaf.NewWatcher(
-		conf.Root, conf.Exclude, fc)
-	if err != nil {
-		log.Fatalf("error creating watcher: %v", err)
+// run runs the commands (at first if told so) and then on
+// every batch of changes until the results are exhausted.
+// Results can be nil, in which case the commands only run
+// at first.
+func (p *pipeline) run(ctx context.Context, results <-chan leaf.WatchResult, runFirst bool) {
+	// Commands are not running until they are run the first
+	// time and waiting for them to be done would block forever.
+	running := false
+	cmdCtx, killCmds := context.WithCancel(ctx)
+	if runFirst {
+		go p.commander.Run(cmdCtx)
+		running = true
 	}
 
-	cmdCtx, killCmds := context.WithCancel(ctx)
-	go commander.Run(cmdCtx)
+	batcher := leaf.NewBatcher(leaf.Batcher{
+		Window:  p.conf.Delay,
+		MaxWait: p.conf.MaxDelay,
+	})
 
-	if !once {
-		for wr := range watcher.Watch(ctx) {
-			if wr.Err != nil {
-				log.Errorf("error while watching: %v", err)
+	breaker := leaf.NewStormBreaker(leaf.StormBreaker{
+		Threshold: p.conf.StormThreshold,
+		Interval:  p.conf.StormInterval,
+		Cooldown:  p.conf.StormCooldown,
+		OnTrip: func(events int, interval time.Duration) {
+			log.Warnf("event storm: %d events in %s, pausing commands until it settles",
+				events, interval)
+		},
+		OnResume: func(held int) {
+			log.Infof("event storm settled, %d files changed meanwhile", held)
+		},
+	})
+
+	if results != nil {
+		var dropped uint64
+		for cs := range batcher.Batch(ctx, breaker.Guard(ctx, results)) {
+			if cs.Err != nil {
+				log.Errorf("error while watching: %v", cs.Err)
 				continue
 			}
 
-			log.Infof("file '%s' changed, reloading...", wr.File)
+			if p.dropped != nil {
+				if d := p.dropped(); d > dropped {
+					log.Warnf("%d events dropped because the buffer was full", d-dropped)
+					dropped = d
+				}
+			}
+
+			for _, c := range cs.Changes {
+				log.Debugf("%s on '%s'", c.Op, c.File)
+			}
+
+			cs = cs.Filter(p.events)
+			if len(cs.Changes) == 0 {
+				continue
+			}
+
+			if len(cs.Changes) == 1 && cs.Changes[0].Op == leaf.OpRepo {
+				log.Infof("repository '%s' changed, reloading...",
+					cs.Changes[0].File)
+			} else if len(cs.Changes) == 1 {
+				log.Infof("file '%s' changed (%s), reloading...",
+					cs.Changes[0].File, cs.Changes[0].Op)
+			} else {
+				log.Infof("%d files changed, reloading...", len(cs.Changes))
+			}
+
+			if p.recorder != nil {
+				err := p.recorder.Record(leaf.Record{
+					Kind:  leaf.RecordTrigger,
+					Files: cs.Files(),
+				})
+				if err != nil {
+					log.Warnf("cannot record trigger: %v", err)
+				}
+			}
 
 			killCmds()                                 // kill previous commands
 			cmdCtx, killCmds = context.WithCancel(ctx) // new context
-			time.Sleep(conf.Delay)                     // wait for 'delay' duration
-			<-commander.Done()                         // wait more if required by commands
-			go commander.Run(cmdCtx)                   // run commands
+			if running {
+				<-p.commander.Done() // wait more if required by commands
+			}
+			go p.commander.Run(cmdCtx) // run commands
+			running = true
 		}
 
-		killCmds()
+		// The commands are killed when closing and waited upon
+		// when the results are exhausted otherwise, like at
+		// the end of a replay.
+		if ctx.Err() != nil {
+			killCmds()
+		}
 	}
 
-	<-commander.Done()
+	if running {
+		<-p.commander.Done()
+	}
+	killCmds()
+}
 
-	log.Infoln("shutdown successfully")
+// runReplay replays the recorded events and executes the
+// commands from the config (or only logs them on a dry run)
+// as they would have been on file change.
+func runReplay(conf *leaf.Config, recording string) error {
+	ctx := leaf.NewCmdContext(func(s os.Signal) {
+		log.Infof("closing: signal received: %s", s.String())
+	})
+
+	f, err := os.Open(recording)
+	if err != nil {
+		return err
+	}
+	defer f.Close() // nolint:errcheck
+
+	records, err := leaf.ReadRecords(f)
+	if err != nil {
+		return fmt.Errorf("error reading recording: %v", err)
+	}
+
+	triggers := 0
+	for _, rec := range records {
+		if rec.Kind == leaf.RecordTrigger {
+			triggers++
+		}
+	}
+	log.Infof("replaying %d entries (%d runs of commands recorded)",
+		len(records), triggers)
+
+	events, err := leaf.ParseOps(conf.Events)
+	if err != nil {
+		log.Fatalf("error parsing events: %v", err)
+	}
+
+	// Results are filtered by the filters of their root, like
+	// while watching, and the ones of individual files aren't.
+	roots := []leaf.WatchRoot{}
+	for _, root := range conf.Root {
+		roots = append(roots, leaf.WatchRoot{
+			Path:    root,
+			Filters: createFilters(conf, root),
+		})
+	}
+
+	p := &pipeline{
+		conf:      conf,
+		commander: newCommander(conf, dryRun),
+		events:    events,
+	}
+	replayer := leaf.NewReplayer(leaf.Replayer{
+		Speed:  speed,
+		MaxGap: maxGap,
+		Roots:  roots,
+	})
+	p.run(ctx, replayer.Replay(ctx, records, nil), false)
+
+	log.Infoln("replay done")
 	return nil
 }
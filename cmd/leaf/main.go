@@ -26,19 +26,41 @@
 //
 // 	Available Commands:
 // 	  help        Help about any command
+// 	  replay      replays a recorded watch session
 // 	  version     prints leaf version
 //
 // 	Flags:
-// 	  -c, --config string     config path for the configuration file (default "<CWD>/.leaf.yml")
-// 	      --debug             run in development (debug) environment
-// 	  -d, --delay duration    delay after which commands are run on file change (default 500ms)
-// 	  -e, --exclude strings   paths to exclude from watching (default [.git/,node_modules/,vendor/,venv/])
-// 	  -x, --exec strings      exec commands on file change
-// 	  -z, --exit-on-err       exit chain of commands on error
-// 	  -f, --filters strings   filters to apply to watch
-// 	  -h, --help              help for leaf
-// 	  -o, --once              run once and exit (no reload)
-// 	  -r, --root string       root directory to watch (default "<CWD>")
+// 	      --buffer-size int           number of events buffered while commands are running (default 64)
+// 	  -c, --config string             config path for the configuration file (default "<CWD>/.leaf.yml")
+// 	      --debug                     run in development (debug) environment
+// 	  -d, --delay duration            delay after the last file change after which commands are run (default 500ms)
+// 	      --events strings            events (create, write, remove, rename, chmod, repo) that trigger commands (default [create,write,remove,rename,repo])
+// 	  -e, --exclude strings           paths to exclude from watching (default [.git/,node_modules/,vendor/,venv/])
+// 	  -x, --exec strings              exec commands on file change
+// 	  -z, --exit-on-err               exit chain of commands on error
+// 	      --files strings             files to watch in addition to the root directories
+// 	      --filter-handler string     how filters are evaluated (standard: excludes win, ordered: last match wins) (default "standard")
+// 	  -f, --filters strings           filters to apply to watch
+// 	      --follow-symlinks           watch directories that symbolic links point to
+// 	      --git                       report git operations (checkout, commit, ...) as a single repo event
+// 	      --gitignore                 ignore paths listed in .gitignore files
+// 	      --hash                      ignore writes that don't change the content of files
+// 	      --hash-cache-size int       number of files for which content hash is remembered (default 4096)
+// 	  -h, --help                      help for leaf
+// 	      --max-delay duration        maximum delay after the first file change after which commands are run (default 5s)
+// 	  -o, --once                      run once and exit (no reload)
+// 	      --overflow-policy string    policy when the event buffer is full (block, drop-newest, drop-oldest, coalesce) (default "coalesce")
+// 	      --poll                      poll for changes instead of using file system notifications
+// 	      --poll-interval duration    interval after which files are polled for changes (default 1s)
+// 	      --poll-on-limit             poll directories that exceed the watch limit instead of exiting
+// 	      --record string             record events, filter decisions and triggers to the file
+// 	      --rescan-on-overflow        scan directories again when events overflow (default true)
+// 	  -r, --root strings              root directories to watch (default [<CWD>])
+// 	      --since-last-run            run commands at start only if files changed since the last run
+// 	      --state-dir string          directory to store the state between runs (default ".leaf")
+// 	      --storm-cooldown duration   duration of calm after which paused commands resume (default 5s)
+// 	      --storm-interval duration   interval over which the rate of events is measured (default 1s)
+// 	      --storm-threshold int       events per storm interval above which commands are paused (0 to disable) (default 1000)
 //
 // 	Use "leaf [command] --help" for more information about a command.
 //
@@ -50,30 +72,126 @@
 //
 // 	# Leaf configuration file.
 //
-// 	# Root directory to watch.
+// 	# Root directory to watch. Multiple directories can be
+// 	# watched by specifying a list, e.g., `root: [., ../lib]`.
+// 	# Relative paths are relative to the directory of this file.
 // 	# Defaults to current working directory.
 // 	root: .
 //
+// 	# Individual files to watch in addition to the root. These
+// 	# can be outside the root and only the changes to these files
+// 	# are reported, e.g., `files: [~/.config/app/dev.yaml]`.
+// 	# Relative paths are relative to the directory of this file.
+// 	files: []
+//
+// 	# Watch the directories that symbolic links inside the root
+// 	# point to. A directory linked multiple times is watched once.
+// 	follow_symlinks: false
+//
 // 	# Exclude directories while watching.
 // 	# If certain directories are not excluded, it might reach a
 // 	# limitation where watcher doesn't start.
+// 	# Paths are relative to the root and can be glob patterns,
+// 	# where '**' matches any number of directories, e.g.,
+// 	# '**/testdata' or '*/dist'.
 // 	exclude:
 // 	  - DEFAULTS # This includes the default ignored directories
 // 	  - build/
 // 	  - scripts/
 //
+// 	# Ignore the paths listed in .gitignore files (nested ones
+// 	# included). Paths listed in .leafignore files, which follow
+// 	# the same syntax, are always ignored.
+// 	gitignore: false
+//
 // 	# Filters to apply on the watch.
 // 	# Filters starting with '+' are includent and then with '-'
 // 	# are excluded. This is not like exclude, these are still
 // 	# being watched yet can be excluded from the execution.
-// 	# These can include any regex supported by filepath.Match
-// 	# method or even a directory.
+// 	# Paths are relative to the root (each one if there are many)
+// 	# and are glob patterns (like filepath.Match) where '**'
+// 	# matches any number of directories, e.g., 'internal/**/*.go'.
+// 	# Patterns without a slash match the name of files at any
+// 	# depth, i.e., '*.go' is the same as '**/*.go'. A pattern
+// 	# matching a directory matches everything inside it.
+// 	# Patterns starting with '=~' are regular expressions matched
+// 	# against the path relative to the root, e.g.,
+// 	# '- =~ _(test|gen)\.go$'.
+// 	# Patterns can be followed by conditions on the event after
+// 	# an 'if', separated by commas, that should all hold for the
+// 	# filter to match: the operation ('op=create|remove',
+// 	# 'op!=chmod'), the size ('size>1M'), the time since the file
+// 	# was modified ('mtime<1h'), the mode ('mode=dir|exec',
+// 	# 'mode=0644') and whether the file is binary or empty
+// 	# ('binary', '!empty'), e.g., '- *.tmp if empty'.
 // 	filters:
 // 	  - '+ go.mod'
 // 	  - '+ go.sum'
 // 	  - '+ *.go'
 // 	  - '+ cmd/'
 //
+// 	# How the filters are evaluated. With 'standard' an exclude
+// 	# always wins over an include. With 'ordered' the filters are
+// 	# evaluated in order and the last one matching a path wins, so
+// 	# that a path can be included again after being excluded, e.g.,
+// 	# ['- gen/', '+ gen/api.go']. Paths that match no filter are
+// 	# then only included if the first filter is an exclude.
+// 	filter_handler: standard
+//
+// 	# Events on files that trigger the commands. These can be
+// 	# any of create, write, remove, rename, chmod and repo (see
+// 	# 'git' below). Defaults to all but chmod.
+// 	events:
+// 	  - create
+// 	  - write
+// 	  - remove
+// 	  - rename
+// 	  - repo
+//
+// 	# Watch the state (HEAD and refs) of the git repository. The
+// 	# changes made by a git operation, like a checkout, rebase or
+// 	# stash, are collapsed into a single 'repo' event that only
+// 	# triggers the commands if it's one of the 'events'. The
+// 	# other changes inside the repository are delayed by half a
+// 	# second to tell them apart.
+// 	git: false
+//
+// 	# Backend used to watch for changes. Use 'poll' where file
+// 	# system notifications don't work, like network file systems
+// 	# or volumes mounted in containers.
+// 	backend: fsnotify
+//
+// 	# Interval after which the poll backend checks for changes.
+// 	poll_interval: 1s
+//
+// 	# Poll the directories that exceed the limit of watches set by
+// 	# the kernel (fs.inotify.max_user_watches) instead of exiting.
+// 	poll_on_limit: false
+//
+// 	# Scan the directories again when the kernel event queue
+// 	# overflows so that no change is lost.
+// 	rescan_on_overflow: true
+//
+// 	# Number of events buffered while the commands are running and
+// 	# what happens when the buffer is full: "block" (stall the
+// 	# watcher), "drop-newest", "drop-oldest" or "coalesce" (merge
+// 	# events of the same file).
+// 	buffer_size: 64
+// 	overflow_policy: coalesce
+//
+// 	# Ignore writes that don't change the content of a file, like
+// 	# formatters rewriting files with identical bytes. Hashes are
+// 	# remembered for at most 'hash_cache_size' files.
+// 	hash: false
+// 	hash_cache_size: 4096
+//
+// 	# Compare the files with the snapshot of the last run at start
+// 	# and run the commands only if any of them changed. Snapshots
+// 	# are stored in the 'state_dir' directory, which is relative
+// 	# to the directory of this file.
+// 	since_last_run: false
+// 	state_dir: .leaf
+//
 // 	# Commands to be executed. These are run in the provided order.
 // 	exec:
 // 	  - make format
@@ -82,9 +200,22 @@
 // 	# Stop the command chain when an error occurs
 // 	exit_on_err: true
 //
-// 	# Delay after which commands are executed.
+// 	# Delay after the last change after which commands are
+// 	# executed. Every change during the delay restarts it.
 // 	delay: 1s
 //
+// 	# Maximum delay after the first change after which commands
+// 	# are executed even if changes keep occurring.
+// 	max_delay: 5s
+//
+// 	# Pause the commands during an event storm, i.e., more than
+// 	# 'storm_threshold' events in 'storm_interval', and resume once
+// 	# the rate stays below it for 'storm_cooldown'. Set the
+// 	# threshold to 0 to never pause.
+// 	storm_threshold: 1000
+// 	storm_interval: 1s
+// 	storm_cooldown: 5s
+//
 // The above config file is suitable to use with the current
 // project itself. It can also be translated into a command
 // as such:
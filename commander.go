@@ -23,6 +23,10 @@ type Commander struct {
 
 	ExitOnError bool
 
+	// DryRun only reports the commands (through OnStart)
+	// without executing them.
+	DryRun bool
+
 	done chan bool
 }
 
@@ -34,6 +38,7 @@ func NewCommander(commander Commander) *Commander {
 		OnError:     commander.OnError,
 		OnExit:      commander.OnExit,
 		ExitOnError: commander.ExitOnError,
+		DryRun:      commander.DryRun,
 		done:        make(chan bool, 1),
 	}
 }
@@ -73,6 +78,10 @@ func (c *Commander) Run(ctx context.Context) {
 				c.OnStart(cmd)
 			}
 
+			if c.DryRun {
+				continue
+			}
+
 			if err := cmd.Execute(ctx); err != nil {
 				if c.OnError != nil {
 					c.OnError(err)
@@ -0,0 +1,328 @@
+package leaf
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// binarySniffLen is the number of bytes at the start of a file
+// that are checked for a null byte to tell if it's binary,
+// like git does.
+const binarySniffLen = 8000
+
+// FileEvent is a change to a file that the filters evaluate.
+// The attributes of the file are read lazily, only when a
+// condition of a filter needs them.
+type FileEvent struct {
+	Path string
+	Op   Op
+
+	loaded bool
+	info   os.FileInfo
+	binary *bool
+}
+
+// NewFileEvent creates the event for the operation on the file.
+func NewFileEvent(path string, op Op) *FileEvent {
+	return &FileEvent{Path: path, Op: op}
+}
+
+// Info returns the attributes (size, mode, modification time
+// etc.) of the file. It's nil if the file doesn't exist, e.g.,
+// after it's removed.
+func (e *FileEvent) Info() os.FileInfo {
+	if !e.loaded {
+		e.info, _ = os.Stat(e.Path) // nolint:errcheck
+		e.loaded = true
+	}
+
+	return e.info
+}
+
+// IsBinary tells if the file is binary, i.e., there's a null
+// byte in the first few thousand bytes of the file.
+func (e *FileEvent) IsBinary() bool {
+	if e.binary != nil {
+		return *e.binary
+	}
+
+	binary := false
+	if info := e.Info(); info != nil && info.Mode().IsRegular() {
+		binary = isBinaryFile(e.Path)
+	}
+
+	e.binary = &binary
+	return binary
+}
+
+// Condition is a condition on the event, in addition to the
+// pattern, for a filter to match, like `op=create|remove` or
+// `size>1M`.
+type Condition struct {
+	Expr string
+
+	match func(*FileEvent) bool
+}
+
+// Matches tells if the event satisfies the condition.
+func (c Condition) Matches(e *FileEvent) bool {
+	return c.match(e)
+}
+
+// conditionRegexp splits a comparison into the attribute, the
+// operator and the value.
+var conditionRegexp = regexp.MustCompile(`^(\w+)\s*(!=|<=|>=|=|<|>)\s*(.+)$`)
+
+// ParseCondition creates the condition from the expression,
+// which is one of:
+//
+//	op=create|remove   the operation is one of these
+//	op!=chmod          the operation is none of these
+//	size>1M            the size compares (=, !=, <, <=, >, >=)
+//	                   with the given bytes (K, M, G suffixes)
+//	mtime<1h           the file was modified within (<, <=) or
+//	                   before (>, >=) the duration
+//	mode=dir|exec      the file is one of file, dir or exec
+//	                   (executable) or has the permissions,
+//	                   like 0644
+//	binary, empty      the file is binary or empty
+//
+// Conditions on the attributes of the file never match a file
+// that doesn't exist. Conditions of the flag kind can be
+// negated with a '!', like `!binary`.
+func ParseCondition(expr string) (Condition, error) {
+	expr = strings.Trim(expr, " ")
+	c := Condition{Expr: expr}
+
+	switch strings.ToLower(expr) {
+	case "binary":
+		c.match = func(e *FileEvent) bool { return e.IsBinary() }
+		return c, nil
+
+	case "!binary":
+		c.match = func(e *FileEvent) bool { return e.Info() != nil && !e.IsBinary() }
+		return c, nil
+
+	case "empty":
+		c.match = func(e *FileEvent) bool { return isEmpty(e.Info()) }
+		return c, nil
+
+	case "!empty":
+		c.match = func(e *FileEvent) bool { return e.Info() != nil && !isEmpty(e.Info()) }
+		return c, nil
+	}
+
+	m := conditionRegexp.FindStringSubmatch(expr)
+	if m == nil {
+		return c, fmt.Errorf("invalid condition '%s'", expr)
+	}
+
+	attr, operator, value := strings.ToLower(m[1]), m[2], strings.Trim(m[3], " ")
+
+	var err error
+	switch attr {
+	case "op":
+		c.match, err = opCondition(operator, value)
+
+	case "size":
+		c.match, err = sizeCondition(operator, value)
+
+	case "mtime":
+		c.match, err = mtimeCondition(operator, value)
+
+	case "mode":
+		c.match, err = modeCondition(operator, value)
+
+	default:
+		err = fmt.Errorf("unknown attribute '%s'", attr)
+	}
+
+	if err != nil {
+		return c, fmt.Errorf("invalid condition '%s': %v", expr, err)
+	}
+
+	return c, nil
+}
+
+// opCondition matches the operation of the event.
+func opCondition(operator, value string) (func(*FileEvent) bool, error) {
+	op, err := ParseOps(strings.Split(value, "|"))
+	if err != nil {
+		return nil, err
+	}
+
+	switch operator {
+	case "=":
+		return func(e *FileEvent) bool { return e.Op.Has(op) }, nil
+
+	case "!=":
+		return func(e *FileEvent) bool { return !e.Op.Has(op) }, nil
+	}
+
+	return nil, fmt.Errorf("operator '%s' not supported for op", operator)
+}
+
+// sizeCondition compares the size of the file.
+func sizeCondition(operator, value string) (func(*FileEvent) bool, error) {
+	size, err := parseSize(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(e *FileEvent) bool {
+		info := e.Info()
+		return info != nil && compareInt64(info.Size(), operator, size)
+	}, nil
+}
+
+// mtimeCondition compares the time since the file was
+// modified, i.e., `mtime<1h` matches the files modified
+// within the last hour.
+func mtimeCondition(operator, value string) (func(*FileEvent) bool, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if operator == "=" || operator == "!=" {
+		return nil, fmt.Errorf("operator '%s' not supported for mtime", operator)
+	}
+
+	return func(e *FileEvent) bool {
+		info := e.Info()
+		return info != nil && compareInt64(
+			int64(time.Since(info.ModTime())), operator, int64(d))
+	}, nil
+}
+
+// modeCondition matches the kind or the permissions of the
+// file.
+func modeCondition(operator, value string) (func(*FileEvent) bool, error) {
+	if operator != "=" && operator != "!=" {
+		return nil, fmt.Errorf("operator '%s' not supported for mode", operator)
+	}
+
+	checks := []func(os.FileMode) bool{}
+	for _, kind := range strings.Split(value, "|") {
+		kind = strings.ToLower(strings.Trim(kind, " "))
+
+		switch kind {
+		case "file":
+			checks = append(checks, os.FileMode.IsRegular)
+
+		case "dir":
+			checks = append(checks, os.FileMode.IsDir)
+
+		case "exec":
+			checks = append(checks, func(m os.FileMode) bool {
+				return m.IsRegular() && m.Perm()&0111 != 0
+			})
+
+		default:
+			perm, err := strconv.ParseUint(kind, 8, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid mode '%s'", kind)
+			}
+
+			checks = append(checks, func(m os.FileMode) bool {
+				return m.Perm() == os.FileMode(perm)
+			})
+		}
+	}
+
+	return func(e *FileEvent) bool {
+		info := e.Info()
+		if info == nil {
+			return false
+		}
+
+		matched := false
+		for _, check := range checks {
+			if check(info.Mode()) {
+				matched = true
+				break
+			}
+		}
+
+		return matched == (operator == "=")
+	}, nil
+}
+
+// parseSize parses the size in bytes with an optional unit,
+// like `512`, `10K`, `1.5MB` or `2G`.
+func parseSize(value string) (int64, error) {
+	units := []struct {
+		suffix string
+		bytes  float64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1 << 10}, {"m", 1 << 20}, {"g", 1 << 30},
+		{"b", 1},
+	}
+
+	lower := strings.ToLower(value)
+	multiplier := 1.0
+	for _, u := range units {
+		if strings.HasSuffix(lower, u.suffix) {
+			lower = strings.TrimSuffix(lower, u.suffix)
+			multiplier = u.bytes
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(strings.Trim(lower, " "), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", value)
+	}
+
+	return int64(n * multiplier), nil
+}
+
+// compareInt64 compares a with b using the operator.
+func compareInt64(a int64, operator string, b int64) bool {
+	switch operator {
+	case "=":
+		return a == b
+	case "!=":
+		return a != b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	}
+
+	return false
+}
+
+// isEmpty tells if the file is a regular file with no content.
+func isEmpty(info os.FileInfo) bool {
+	return info != nil && info.Mode().IsRegular() && info.Size() == 0
+}
+
+// isBinaryFile tells if there's a null byte at the start of
+// the file.
+func isBinaryFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close() // nolint:errcheck
+
+	buf := make([]byte, binarySniffLen)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false
+	}
+
+	return bytes.IndexByte(buf[:n], 0) >= 0
+}
@@ -0,0 +1,161 @@
+package leaf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value string
+		size  int64
+		valid bool
+	}{
+		{"0", 0, true},
+		{"512", 512, true},
+		{"512b", 512, true},
+		{"10K", 10 << 10, true},
+		{"10kb", 10 << 10, true},
+		{"1.5M", 3 << 19, true},
+		{"1.5MB", 3 << 19, true},
+		{"2G", 2 << 30, true},
+		{"2 g", 2 << 30, true},
+		{"", 0, false},
+		{"K", 0, false},
+		{"-1K", 0, false},
+		{"1T", 0, false},
+		{"ten", 0, false},
+	}
+
+	for _, tt := range tests {
+		size, err := parseSize(tt.value)
+		if (err == nil) != tt.valid {
+			t.Errorf("parseSize(%q) error = %v, want valid %v", tt.value, err, tt.valid)
+			continue
+		}
+
+		if size != tt.size {
+			t.Errorf("parseSize(%q) = %d, want %d", tt.value, size, tt.size)
+		}
+	}
+}
+
+func TestParseConditionInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"large",
+		"op=edit",
+		"op>create",
+		"size>big",
+		"mtime=1h",
+		"mtime<1 hour",
+		"mode>dir",
+		"mode=socket",
+		"owner=root",
+	} {
+		if _, err := ParseCondition(expr); err == nil {
+			t.Errorf("ParseCondition(%q) has no error", expr)
+		}
+	}
+}
+
+func TestParseCondition(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leaf-conditions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint:errcheck
+
+	files := []struct {
+		name    string
+		content string
+		perm    os.FileMode
+	}{
+		{"text.go", "package leaf\n", 0644},
+		{"empty.txt", "", 0600},
+		{"image.png", "\x89PNG\x00\x00", 0644},
+		{"run.sh", "#!/bin/sh\n", 0755},
+		{"large.bin", string(make([]byte, 2<<10)), 0644},
+	}
+
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		if err := ioutil.WriteFile(path, []byte(f.content), f.perm); err != nil {
+			t.Fatal(err)
+		}
+
+		// The permissions might be masked while creating.
+		if err := os.Chmod(path, f.perm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		expr    string
+		name    string
+		op      Op
+		matched bool
+	}{
+		{"op=create|remove", "text.go", OpCreate, true},
+		{"op=create|remove", "text.go", OpWrite, false},
+		{"op = write", "text.go", OpCreate | OpWrite, true},
+		{"op!=chmod", "text.go", OpWrite, true},
+		{"op!=chmod", "text.go", OpChmod, false},
+
+		// Operations don't need the file to exist.
+		{"op=remove", "missing.go", OpRemove, true},
+
+		{"size>1K", "large.bin", OpWrite, true},
+		{"size>1K", "text.go", OpWrite, false},
+		{"size<=13", "text.go", OpWrite, true},
+		{"size=0", "empty.txt", OpWrite, true},
+		{"size!=0", "empty.txt", OpWrite, false},
+		{"size<1K", "missing.go", OpRemove, false},
+
+		{"mtime<1h", "text.go", OpWrite, true},
+		{"mtime>1h", "text.go", OpWrite, false},
+		{"mtime<1h", "missing.go", OpRemove, false},
+
+		{"mode=file", "text.go", OpWrite, true},
+		{"mode=file", "sub", OpCreate, false},
+		{"mode=dir", "sub", OpCreate, true},
+		{"mode=exec", "run.sh", OpWrite, true},
+		{"mode=exec", "text.go", OpWrite, false},
+		{"mode=dir|exec", "run.sh", OpWrite, true},
+		{"mode=0600", "empty.txt", OpWrite, true},
+		{"mode!=0600", "text.go", OpWrite, true},
+		{"mode!=dir", "missing.go", OpRemove, false},
+
+		{"binary", "image.png", OpWrite, true},
+		{"binary", "large.bin", OpWrite, true},
+		{"binary", "text.go", OpWrite, false},
+		{"!binary", "text.go", OpWrite, true},
+		{"!binary", "missing.go", OpRemove, false},
+		{"BINARY", "image.png", OpWrite, true},
+
+		{"empty", "empty.txt", OpWrite, true},
+		{"empty", "text.go", OpWrite, false},
+		{"empty", "sub", OpCreate, false},
+		{"!empty", "text.go", OpWrite, true},
+		{"!empty", "missing.go", OpRemove, false},
+	}
+
+	for _, tt := range tests {
+		c, err := ParseCondition(tt.expr)
+		if err != nil {
+			t.Errorf("ParseCondition(%q): %v", tt.expr, err)
+			continue
+		}
+
+		event := NewFileEvent(filepath.Join(dir, tt.name), tt.op)
+		if got := c.Matches(event); got != tt.matched {
+			t.Errorf("%q matching %s on %s = %v, want %v", tt.expr, tt.op, tt.name, got, tt.matched)
+		}
+	}
+}
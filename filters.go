@@ -2,7 +2,9 @@ package leaf
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 )
 
@@ -10,14 +12,59 @@ import (
 type Filter struct {
 	Include bool // whether to include pattern
 	Pattern string
+
+	// Regexp, if set, is matched against the path relative
+	// to the Base directory instead of matching the Pattern.
+	Regexp *regexp.Regexp
+	Base   string
+
+	// Conditions on the event, like the operation or the
+	// size of the file, that should all be satisfied along-with
+	// the pattern for the filter to match.
+	Conditions []Condition
 }
 
-// NewFilter creates a filter from the pattern string. The
+// RegexpMarker marks the pattern of a filter as a regular
+// expression.
+const RegexpMarker = "=~"
+
+// NewFilter creates a filter from the pattern string relative
+// to the working directory. See NewFilterRelativeTo.
+func NewFilter(pattern string) (Filter, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return Filter{}, fmt.Errorf(
+			"error making path absolute: %v", err)
+	}
+
+	return NewFilterRelativeTo(pattern, cwd)
+}
+
+// NewFilterRelativeTo creates a filter from the pattern string
+// relative to the base directory, usually the root. The
 // pattern either starts with '+' or '-' to include or
 // exclude the directory from results.
-func NewFilter(pattern string) (Filter, error) {
+//
+// The pattern is a glob where "**" matches any number of
+// directories, e.g., `internal/**/testdata/**`. A relative
+// pattern with a slash is relative to the base directory
+// while a pattern without a slash matches the base name of
+// files (or directories) at any depth inside it, i.e., `*.go`
+// is the same as `**/*.go`.
+//
+// A pattern starting with RegexpMarker ("=~") is a regular
+// expression that is matched against the path relative to the
+// base directory, with '/' as the separator, e.g.,
+// `+ =~ ^internal/.*\.go$`. A path starting with the marker
+// can still be matched with a glob as `./=~name`. A pattern
+// starting with '~/' is relative to the home directory.
+//
+// The pattern can be followed by conditions on the event,
+// separated by commas, after an 'if', e.g., `+ *.proto if
+// op=create|remove` or `- * if size>1M, !binary`. See
+// ParseCondition for the conditions.
+func NewFilterRelativeTo(pattern, base string) (Filter, error) {
 	f := Filter{}
-	var err error
 
 	cleanedPattern := strings.Trim(pattern, " ")
 	if len(cleanedPattern) < 2 {
@@ -36,30 +83,96 @@ func NewFilter(pattern string) (Filter, error) {
 	}
 
 	onlyPath := strings.Trim(cleanedPattern[1:], " ")
-	f.Pattern, err = filepath.Abs(onlyPath)
+	if i := strings.LastIndex(onlyPath, " if "); i >= 0 {
+		for _, expr := range strings.Split(onlyPath[i+len(" if "):], ",") {
+			c, err := ParseCondition(expr)
+			if err != nil {
+				return f, err
+			}
+
+			f.Conditions = append(f.Conditions, c)
+		}
+
+		onlyPath = strings.Trim(onlyPath[:i], " ")
+	}
+
+	base, err := filepath.Abs(base)
 	if err != nil {
 		return f, fmt.Errorf(
 			"error making path absolute: %v", err)
 	}
 
+	if strings.HasPrefix(onlyPath, RegexpMarker) {
+		f.Pattern = strings.Trim(onlyPath[len(RegexpMarker):], " ")
+		f.Base = base
+
+		f.Regexp, err = regexp.Compile(f.Pattern)
+		if err != nil {
+			return f, err
+		}
+
+		return f, nil
+	}
+
+	onlyPath, err = expandHome(onlyPath)
+	if err != nil {
+		return f, err
+	}
+
+	if !filepath.IsAbs(onlyPath) {
+		if !strings.ContainsRune(onlyPath, '/') {
+			onlyPath = filepath.Join("**", onlyPath)
+		}
+
+		onlyPath = filepath.Join(escapeGlob(base), onlyPath)
+	}
+
+	f.Pattern = filepath.Clean(onlyPath)
 	return f, nil
 }
 
 // A FilterCollection contains a bunch of includes and excludes.
 type FilterCollection struct {
+	// Filters are the filters in the order they are written,
+	// which decide the paths that are handled.
+	Filters []Filter
+
+	// Includes and Excludes are the glob patterns of the
+	// Filters, i.e., without the regular expressions. These are
+	// only for reference and changing them doesn't change the
+	// paths handled, change the Filters instead.
 	Includes []string
 	Excludes []string
 
-	match  FilterMatchFunc
+	match  FilterEventMatchFunc
 	handle FilterHandleFunc
+
+	// event is the event being evaluated, if known, for the
+	// conditions of the filters.
+	event *FileEvent
 }
 
 // NewFilterCollection creates a filter collection from a bunch
 // of filter patterns.
 func NewFilterCollection(filters []Filter, mf FilterMatchFunc, hf FilterHandleFunc) *FilterCollection {
+	var emf FilterEventMatchFunc
+	if mf != nil {
+		emf = func(pattern string, event *FileEvent) bool {
+			return mf(pattern, event.Path)
+		}
+	}
+
+	return NewEventFilterCollection(filters, emf, hf)
+}
+
+// NewEventFilterCollection creates a filter collection from a
+// bunch of filter patterns, whose match function gets the
+// event being evaluated.
+func NewEventFilterCollection(filters []Filter, mf FilterEventMatchFunc, hf FilterHandleFunc) *FilterCollection {
 	collection := &FilterCollection{
 		Includes: []string{},
 		Excludes: []string{},
+		Filters:  filters,
 		match:    mf,
 		handle:   hf,
 	}
@@ -69,6 +182,10 @@ func NewFilterCollection(filters []Filter, mf FilterMatchFunc, hf FilterHandleFu
 	}
 
 	for _, f := range filters {
+		if f.Regexp != nil {
+			continue
+		}
+
 		if f.Include {
 			collection.Includes = append(collection.Includes, f.Pattern)
 		} else {
@@ -80,14 +197,29 @@ func NewFilterCollection(filters []Filter, mf FilterMatchFunc, hf FilterHandleFu
 }
 
 // NewFCFromPatterns creates a filter collection from a list of
-// string format filters, like `+ /path/to/some/dir`.
+// string format filters, like `+ /path/to/some/dir`, relative
+// to the working directory. Errors are reported along-with
+// the pattern and its position in the list.
 func NewFCFromPatterns(patterns []string, mf FilterMatchFunc, hf FilterHandleFunc) (*FilterCollection, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf(
+			"error making path absolute: %v", err)
+	}
+
+	return NewFCFromPatternsRelativeTo(patterns, cwd, mf, hf)
+}
+
+// NewFCFromPatternsRelativeTo creates a filter collection from
+// a list of string format filters relative to the base
+// directory, usually the root.
+func NewFCFromPatternsRelativeTo(patterns []string, base string, mf FilterMatchFunc, hf FilterHandleFunc) (*FilterCollection, error) {
 	filters := []Filter{}
 
-	for _, p := range patterns {
-		f, err := NewFilter(p)
+	for i, p := range patterns {
+		f, err := NewFilterRelativeTo(p, base)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("filter %d '%s': %v", i+1, p, err)
 		}
 
 		filters = append(filters, f)
@@ -101,30 +233,26 @@ func NewFCFromPatterns(patterns []string, mf FilterMatchFunc, hf FilterHandleFun
 // the given pattern.
 type FilterMatchFunc func(pattern, path string) bool
 
+// FilterEventMatchFunc is like FilterMatchFunc but compares the
+// pattern with the event, which has the operation and the
+// attributes of the file changed along-with its path.
+type FilterEventMatchFunc func(pattern string, event *FileEvent) bool
+
 // StandardFilterMatcher matches the pattern with the path
-// and returns true if the path either starts with
-// (in absolute terms) or matches like the path regex.
+// and returns true if the path or any of its parent
+// directories matches the pattern. Each segment of the path
+// is matched like filepath.Match and a "**" segment matches
+// any number of directories.
 func StandardFilterMatcher(pattern, path string) bool {
-	matched, err := filepath.Match(pattern, path)
-	if err != nil {
-		return false
-	}
-
-	if matched {
-		return true
-	}
-
-	isDir, err := isDir(pattern)
-	if err != nil || !isDir {
-		return false
-	}
-
-	if len(path) < len(pattern) {
-		return false
-	}
+	return matchSegmentsPrefix(splitPath(pattern), splitPath(path))
+}
 
-	if path[:len(pattern)] == pattern {
-		return true
+// hasIncludes tells if any of the filters is an include.
+func (fc *FilterCollection) hasIncludes() bool {
+	for _, f := range fc.Filters {
+		if f.Include {
+			return true
+		}
 	}
 
 	return false
@@ -135,8 +263,8 @@ func StandardFilterMatcher(pattern, path string) bool {
 func (fc *FilterCollection) HasInclude(path string) bool {
 	cleanedPath := filepath.Clean(path)
 
-	for _, pattern := range fc.Includes {
-		if fc.match(pattern, cleanedPath) {
+	for _, f := range fc.Filters {
+		if f.Include && fc.matchFilter(f, cleanedPath) {
 			return true
 		}
 	}
@@ -149,8 +277,8 @@ func (fc *FilterCollection) HasInclude(path string) bool {
 func (fc *FilterCollection) HasExclude(path string) bool {
 	cleanedPath := filepath.Clean(path)
 
-	for _, pattern := range fc.Excludes {
-		if fc.match(pattern, cleanedPath) {
+	for _, f := range fc.Filters {
+		if !f.Include && fc.matchFilter(f, cleanedPath) {
 			return true
 		}
 	}
@@ -158,13 +286,75 @@ func (fc *FilterCollection) HasExclude(path string) bool {
 	return false
 }
 
+// Event returns the event being evaluated, for the handle
+// function, when the collection is evaluated for an event with
+// ShouldHandleEvent. It's nil otherwise.
+func (fc *FilterCollection) Event() *FileEvent {
+	return fc.event
+}
+
+// eventFor returns the event being evaluated for the path.
+// Only the attributes of the file are known without the event.
+func (fc *FilterCollection) eventFor(path string) *FileEvent {
+	if fc.event == nil || fc.event.Path != path {
+		return NewFileEvent(path, 0)
+	}
+
+	return fc.event
+}
+
+// matchFilter tells if the filter matches the path, either
+// using its regular expression or the match function, and
+// the event satisfies its conditions.
+func (fc *FilterCollection) matchFilter(f Filter, path string) bool {
+	event := fc.eventFor(path)
+	if !fc.matchPattern(f, event) {
+		return false
+	}
+
+	for _, c := range f.Conditions {
+		if !c.Matches(event) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchPattern tells if the pattern of the filter matches the
+// path of the event.
+func (fc *FilterCollection) matchPattern(f Filter, event *FileEvent) bool {
+	if f.Regexp == nil {
+		return fc.match(f.Pattern, event)
+	}
+
+	rel, err := filepath.Rel(f.Base, event.Path)
+	if err != nil {
+		return false
+	}
+
+	return f.Regexp.MatchString(filepath.ToSlash(rel))
+}
+
 // ShouldHandlePath returns the result of the path handler
-// for the filter collection.
+// for the filter collection. Conditions of the filters on the
+// operation don't match since the event isn't known.
 func (fc *FilterCollection) ShouldHandlePath(path string) bool {
 	handlerFunc := fc.handle
 	return handlerFunc(fc, path)
 }
 
+// ShouldHandleEvent returns the result of the path handler
+// for the filter collection, with the conditions of the
+// filters evaluated for the event.
+func (fc *FilterCollection) ShouldHandleEvent(event *FileEvent) bool {
+	event.Path = filepath.Clean(event.Path)
+
+	withEvent := *fc
+	withEvent.event = event
+	return withEvent.handle(&withEvent, event.Path)
+}
+
 // FilterHandleFunc is a function that checks if for the filter
 // collection, should the path be handled or not, i.e., should
 // the notifier tick for change in path or not.
@@ -177,7 +367,7 @@ func StandardFilterHandler(fc *FilterCollection, path string) bool {
 
 	// If there are no includes, path should be handled unless
 	// it is in the excludes.
-	if len(fc.Includes) == 0 || fc.HasInclude(path) {
+	if !fc.hasIncludes() || fc.HasInclude(path) {
 		handle = true
 	}
 
@@ -187,3 +377,48 @@ func StandardFilterHandler(fc *FilterCollection, path string) bool {
 
 	return handle
 }
+
+// OrderedFilterHandler evaluates the filters in the order they
+// are written and the last filter that matches the path
+// decides whether it's included or excluded, like the rules
+// of a gitignore file. This allows to exclude a directory but
+// include a file in it again, e.g., `- gen/` followed by
+// `+ gen/api.go`.
+//
+// A path matching none of the filters is only handled if the
+// first filter is an exclude, i.e., the filters starting with
+// an include only allow what they include.
+func OrderedFilterHandler(fc *FilterCollection, path string) bool {
+	cleanedPath := filepath.Clean(path)
+
+	handle := len(fc.Filters) == 0 || !fc.Filters[0].Include
+	for _, f := range fc.Filters {
+		if fc.matchFilter(f, cleanedPath) {
+			handle = f.Include
+		}
+	}
+
+	return handle
+}
+
+// Names of the filter handlers.
+const (
+	FilterHandlerStandard = "standard"
+	FilterHandlerOrdered  = "ordered"
+)
+
+// ParseFilterHandler returns the filter handler from its name,
+// i.e., "standard" (StandardFilterHandler) or "ordered"
+// (OrderedFilterHandler).
+func ParseFilterHandler(name string) (FilterHandleFunc, error) {
+	switch name {
+	case "", FilterHandlerStandard:
+		return StandardFilterHandler, nil
+
+	case FilterHandlerOrdered:
+		return OrderedFilterHandler, nil
+
+	default:
+		return nil, fmt.Errorf("invalid filter handler '%s'", name)
+	}
+}
@@ -0,0 +1,170 @@
+package leaf
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStandardFilterMatcherGlobs(t *testing.T) {
+	tests := []struct {
+		filter  string
+		path    string
+		matched bool
+	}{
+		// Patterns without a slash match base names at any
+		// depth.
+		{"+ *.go", "/r/main.go", true},
+		{"+ *.go", "/r/cmd/leaf/main.go", true},
+		{"+ *.go", "/r/main.go.txt", false},
+		{"+ *.go", "/other/main.go", false},
+		{"+ go.mod", "/r/sub/go.mod", true},
+
+		// Patterns with a slash are relative to the base.
+		{"+ cmd/*.go", "/r/cmd/main.go", true},
+		{"+ cmd/*.go", "/r/cmd/leaf/main.go", false},
+		{"+ cmd/*.go", "/r/x/cmd/main.go", false},
+		{"+ /r/cmd/*.go", "/r/cmd/main.go", true},
+
+		// "**" matches any number of directories.
+		{"+ internal/**/*.go", "/r/internal/a.go", true},
+		{"+ internal/**/*.go", "/r/internal/a/b/c.go", true},
+		{"+ internal/**/*.go", "/r/pkg/internal/a.go", false},
+		{"+ **/testdata/**", "/r/a/testdata/x.json", true},
+
+		// Directories match everything inside them.
+		{"+ cmd/", "/r/cmd/leaf/main.go", true},
+		{"+ cmd", "/r/x/cmd/main.go", true},
+		{"+ cmd/", "/r/cmdx/main.go", false},
+	}
+
+	for _, tt := range tests {
+		f, err := NewFilterRelativeTo(tt.filter, "/r")
+		if err != nil {
+			t.Errorf("NewFilterRelativeTo(%q): %v", tt.filter, err)
+			continue
+		}
+
+		if got := StandardFilterMatcher(f.Pattern, tt.path); got != tt.matched {
+			t.Errorf("filter %q (pattern %q) matching %q = %v, want %v",
+				tt.filter, f.Pattern, tt.path, got, tt.matched)
+		}
+	}
+}
+
+func TestRegexpFilters(t *testing.T) {
+	tests := []struct {
+		filter  string
+		path    string
+		matched bool
+	}{
+		// Regular expressions match the path relative to the
+		// base.
+		{`+ =~ ^internal/.*\.go$`, "/r/internal/a/b.go", true},
+		{`+ =~ ^internal/.*\.go$`, "/r/pkg/internal/a.go", false},
+		{`+ =~ ^internal/.*\.go$`, "/internal/a.go", false},
+		{`- =~ _test\.go$`, "/r/cmd/main_test.go", true},
+		{`- =~ _test\.go$`, "/r/cmd/main.go", false},
+		{`+ =~ ^cmd$`, "/r/cmd", true},
+
+		// A glob can still start with the marker.
+		{"+ ./=~name", "/r/=~name", true},
+		{"+ ./=~name", "/r/name", false},
+	}
+
+	for _, tt := range tests {
+		f, err := NewFilterRelativeTo(tt.filter, "/r")
+		if err != nil {
+			t.Errorf("NewFilterRelativeTo(%q): %v", tt.filter, err)
+			continue
+		}
+
+		fc := NewFilterCollection([]Filter{f}, StandardFilterMatcher, StandardFilterHandler)
+		if got := fc.matchPattern(f, NewFileEvent(tt.path, OpWrite)); got != tt.matched {
+			t.Errorf("filter %q matching %q = %v, want %v", tt.filter, tt.path, got, tt.matched)
+		}
+	}
+}
+
+func TestNewFCFromPatternsErrors(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		prefix   string
+	}{
+		{[]string{"* .go"}, "filter 1 '* .go': "},
+		{[]string{"+ *.go", "+ =~ ([a-z"}, "filter 2 '+ =~ ([a-z': "},
+		{[]string{"+ *.go", "- vendor/", "+ *.proto if size>big"}, "filter 3 '+ *.proto if size>big': "},
+	}
+
+	for _, tt := range tests {
+		_, err := NewFCFromPatternsRelativeTo(tt.patterns, "/r", StandardFilterMatcher, StandardFilterHandler)
+		if err == nil {
+			t.Errorf("NewFCFromPatternsRelativeTo(%q) has no error", tt.patterns)
+			continue
+		}
+
+		if !strings.HasPrefix(err.Error(), tt.prefix) {
+			t.Errorf("NewFCFromPatternsRelativeTo(%q) error = %q, want it to start with %q",
+				tt.patterns, err, tt.prefix)
+		}
+	}
+}
+
+func TestRegexpFiltersNotInIncludesExcludes(t *testing.T) {
+	fc, err := NewFCFromPatternsRelativeTo([]string{
+		"+ *.go",
+		`+ =~ \.proto$`,
+		"- =~ ^gen/",
+		"- vendor/",
+	}, "/r", StandardFilterMatcher, StandardFilterHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fc.Filters) != 4 {
+		t.Errorf("got %d filters, want 4", len(fc.Filters))
+	}
+
+	if want := []string{"/r/**/*.go"}; !reflect.DeepEqual(fc.Includes, want) {
+		t.Errorf("includes = %q, want %q", fc.Includes, want)
+	}
+
+	if want := []string{"/r/vendor"}; !reflect.DeepEqual(fc.Excludes, want) {
+		t.Errorf("excludes = %q, want %q", fc.Excludes, want)
+	}
+}
+
+func TestOrderedFilterHandler(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		path     string
+		handled  bool
+	}{
+		// The last matching filter decides.
+		{[]string{"- gen/", "+ gen/api.go"}, "/r/gen/api.go", true},
+		{[]string{"- gen/", "+ gen/api.go"}, "/r/gen/types.go", false},
+		{[]string{"+ gen/api.go", "- gen/"}, "/r/gen/api.go", false},
+		{[]string{"+ *.go", "- *_test.go", "+ main_test.go"}, "/r/main_test.go", true},
+		{[]string{"+ *.go", "- *_test.go", "+ main_test.go"}, "/r/a_test.go", false},
+
+		// A path matching no filter is handled only if the
+		// filters start with an exclude.
+		{[]string{"+ *.go", "- gen/"}, "/r/README.md", false},
+		{[]string{"- gen/", "+ gen/api.go"}, "/r/README.md", true},
+
+		// Everything is handled without filters.
+		{[]string{}, "/r/README.md", true},
+	}
+
+	for _, tt := range tests {
+		fc, err := NewFCFromPatternsRelativeTo(tt.patterns, "/r", StandardFilterMatcher, OrderedFilterHandler)
+		if err != nil {
+			t.Errorf("NewFCFromPatternsRelativeTo(%q): %v", tt.patterns, err)
+			continue
+		}
+
+		if got := fc.ShouldHandlePath(tt.path); got != tt.handled {
+			t.Errorf("filters %q handling %q = %v, want %v", tt.patterns, tt.path, got, tt.handled)
+		}
+	}
+}
@@ -0,0 +1,426 @@
+package leaf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GitDir is the name of the directory (or the file pointing
+// to it, for work trees and submodules) of a git repository.
+const GitDir = ".git"
+
+// DefaultGitSettle is the time for which the repository
+// should be quiet for a git operation to be considered done.
+var DefaultGitSettle = 500 * time.Millisecond
+
+// gitRepo is a git repository whose state is watched.
+type gitRepo struct {
+	// top is the top directory of the work tree, dir is the
+	// git directory (with HEAD) and commonDir is the directory
+	// with the refs shared by all the work trees.
+	top       string
+	dir       string
+	commonDir string
+
+	// roots are the watched roots inside the work tree.
+	roots map[string]bool
+
+	// busy is set while a git operation is going on and
+	// changed if the operation changes HEAD or the refs.
+	busy    bool
+	changed bool
+
+	// held are the changes to the work tree waiting for the
+	// repository to settle, reported in order if no git
+	// operation changes the state of the repository.
+	held  map[string]Op
+	order []string
+}
+
+// gitWatch collapses the changes made by git operations,
+// like checkout, rebase or stash, into a single change of the
+// state of the repository.
+//
+// The changes to the work tree are held for the settle
+// duration, since the events of the git directory that tell a
+// git operation is going on might arrive after them. While a
+// git operation is going on, i.e., the index or HEAD is locked
+// or HEAD or the refs change, the changes are held until the
+// repository is quiet for the settle duration. If HEAD or the
+// refs changed, a single result with the OpRepo operation is
+// reported for the git directory instead of the held changes.
+type gitWatch struct {
+	mu    sync.Mutex
+	repos map[string]*gitRepo
+	dirs  map[string]*gitRepo
+
+	settle  time.Duration
+	timer   *time.Timer
+	waiting bool
+}
+
+// newGitWatch creates the git watch with the settle duration.
+func newGitWatch(settle time.Duration) *gitWatch {
+	if settle <= 0 {
+		settle = DefaultGitSettle
+	}
+
+	return &gitWatch{
+		repos:  map[string]*gitRepo{},
+		dirs:   map[string]*gitRepo{},
+		settle: settle,
+		timer:  newStoppedTimer(),
+	}
+}
+
+// wait (re)starts the wait for the repositories to settle.
+func (g *gitWatch) wait() {
+	stopTimer(g.timer)
+	g.timer.Reset(g.settle)
+	g.waiting = true
+}
+
+// waitOnce starts the wait for the repositories to settle
+// unless it's started already, so that the changes held while
+// no git operation is going on aren't delayed any further.
+func (g *gitWatch) waitOnce() {
+	if !g.waiting {
+		g.wait()
+	}
+}
+
+// addGitRepo watches the state of the repository that the
+// root is in, if any.
+func (w *Watcher) addGitRepo(root string) error {
+	top, dir, err := findGitDir(root)
+	if err != nil || dir == "" {
+		return err
+	}
+
+	commonDir, err := gitCommonDir(dir)
+	if err != nil {
+		return err
+	}
+
+	w.git.mu.Lock()
+	defer w.git.mu.Unlock()
+
+	if repo, ok := w.git.repos[dir]; ok {
+		repo.roots[root] = true
+		return nil
+	}
+
+	repo := &gitRepo{
+		top:       top,
+		dir:       dir,
+		commonDir: commonDir,
+		roots:     map[string]bool{root: true},
+		held:      map[string]Op{},
+	}
+	w.git.repos[dir] = repo
+
+	dirs := []string{dir}
+	if commonDir != dir {
+		dirs = append(dirs, commonDir)
+	}
+
+	refs, err := getRefDirs(filepath.Join(commonDir, "refs"))
+	if err != nil {
+		return err
+	}
+
+	for _, d := range append(dirs, refs...) {
+		if err := w.notifier.Add(d); err != nil {
+			return err
+		}
+
+		w.git.dirs[d] = repo
+	}
+
+	return nil
+}
+
+// removeGitRepo stops watching the state of the repository
+// that the root is in once none of its roots is watched.
+func (w *Watcher) removeGitRepo(root string) {
+	w.git.mu.Lock()
+	defer w.git.mu.Unlock()
+
+	for _, repo := range w.git.repos {
+		if !repo.roots[root] {
+			continue
+		}
+
+		delete(repo.roots, root)
+		if len(repo.roots) > 0 {
+			continue
+		}
+
+		for d, r := range w.git.dirs {
+			if r == repo {
+				w.notifier.Remove(d) // nolint:errcheck
+				delete(w.git.dirs, d)
+			}
+		}
+
+		delete(w.git.repos, repo.dir)
+	}
+}
+
+// handleGitEvent tells if the event is on the state of a
+// repository and marks the repository busy if so.
+func (w *Watcher) handleGitEvent(event Event) bool {
+	w.git.mu.Lock()
+	defer w.git.mu.Unlock()
+
+	dir := filepath.Dir(event.Name)
+	repo, ok := w.git.dirs[dir]
+	if !ok {
+		if _, isGitDir := w.git.dirs[event.Name]; isGitDir {
+			// The watch of a removed directory is removed
+			// by the kernel.
+			delete(w.git.dirs, event.Name)
+			return true
+		}
+
+		return false
+	}
+
+	name := filepath.Base(event.Name)
+	isRef := hasPathPrefix(event.Name, filepath.Join(repo.commonDir, "refs")) ||
+		(dir == repo.commonDir && name == "packed-refs")
+
+	switch {
+	case dir == repo.dir && isGitBusyFile(name):
+		// Locking (or updating) the index or HEAD marks the
+		// start of operations that change the work tree. The
+		// lock files are short-lived and the events on them
+		// might be lost, hence any of these marks it.
+		repo.busy = true
+
+	case dir == repo.dir && name == "HEAD":
+		repo.busy = true
+		repo.changed = true
+
+	case isRef && !strings.HasSuffix(name, ".lock"):
+		if event.Op.Has(OpCreate) && isGitRefDir(event.Name) {
+			refs, err := getRefDirs(event.Name)
+			if err == nil {
+				for _, d := range refs {
+					if err := w.notifier.Add(d); err == nil {
+						w.git.dirs[d] = repo
+					}
+				}
+			}
+		}
+
+		if event.Op.Has(OpRemove | OpRename) {
+			delete(w.git.dirs, event.Name)
+		}
+
+		repo.busy = true
+		repo.changed = true
+
+	default:
+		// Other files in the git directory, like the
+		// objects or the index, are of no interest.
+		return true
+	}
+
+	w.git.wait()
+	return true
+}
+
+// holdGitChange holds the result if it's a change to the work
+// tree of a repository until the repository settles.
+func (w *Watcher) holdGitChange(res WatchResult) bool {
+	if res.Err != nil {
+		return false
+	}
+
+	w.git.mu.Lock()
+	defer w.git.mu.Unlock()
+
+	for _, repo := range w.git.repos {
+		if !hasPathPrefix(res.File, repo.top) {
+			continue
+		}
+
+		if _, ok := repo.held[res.File]; !ok {
+			repo.order = append(repo.order, res.File)
+		}
+		repo.held[res.File] |= res.Op
+
+		if repo.busy {
+			w.git.wait()
+		} else {
+			w.git.waitOnce()
+		}
+		return true
+	}
+
+	return false
+}
+
+// settleGit streams the changes of the repositories that are
+// quiet now. The repositories with the index still locked
+// are waited upon.
+func (w *Watcher) settleGit() {
+	results := []WatchResult{}
+
+	w.git.mu.Lock()
+	w.git.waiting = false
+
+	for _, repo := range w.git.repos {
+		if !repo.busy && len(repo.order) == 0 {
+			continue
+		}
+
+		if _, err := os.Stat(filepath.Join(repo.dir, "index.lock")); err == nil {
+			repo.busy = true
+			w.git.wait()
+			continue
+		}
+
+		if repo.changed {
+			results = append(results, WatchResult{File: repo.dir, Op: OpRepo})
+		} else {
+			for _, file := range repo.order {
+				results = append(results, WatchResult{File: file, Op: repo.held[file]})
+			}
+		}
+
+		repo.busy = false
+		repo.changed = false
+		repo.held = map[string]Op{}
+		repo.order = nil
+	}
+	w.git.mu.Unlock()
+
+	for _, res := range results {
+		w.res <- res
+	}
+}
+
+// findGitDir finds the repository that the directory is in
+// and returns the top directory of its work tree and its
+// git directory. The git directory is empty if there's no
+// repository.
+func findGitDir(dir string) (top, gitDir string, err error) {
+	for top = dir; ; top = filepath.Dir(top) {
+		path := filepath.Join(top, GitDir)
+
+		info, err := os.Stat(path)
+		switch {
+		case err == nil && info.IsDir():
+			return top, path, nil
+
+		case err == nil:
+			// Work trees and submodules have a file with the
+			// path to the git directory instead.
+			gitDir, err := readGitDirFile(path)
+			return top, gitDir, err
+
+		case !os.IsNotExist(err):
+			return "", "", err
+		}
+
+		if filepath.Dir(top) == top {
+			return "", "", nil
+		}
+	}
+}
+
+// readGitDirFile reads the path of the git directory from the
+// .git file of a work tree, i.e., "gitdir: <path>".
+func readGitDirFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	content := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(content, "gitdir:") {
+		return "", fmt.Errorf("invalid git file '%s'", path)
+	}
+
+	gitDir := strings.TrimSpace(strings.TrimPrefix(content, "gitdir:"))
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(filepath.Dir(path), gitDir)
+	}
+
+	return filepath.Clean(gitDir), nil
+}
+
+// gitCommonDir returns the directory with the refs of the
+// repository, which differs from the git directory for the
+// linked work trees.
+func gitCommonDir(gitDir string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(gitDir, "commondir"))
+	if os.IsNotExist(err) {
+		return gitDir, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	commonDir := strings.TrimSpace(string(data))
+	if !filepath.IsAbs(commonDir) {
+		commonDir = filepath.Join(gitDir, commonDir)
+	}
+
+	return filepath.Clean(commonDir), nil
+}
+
+// getRefDirs returns the directories with the refs inside the
+// given directory. Remote-tracking refs are skipped since
+// fetching doesn't change the state of the work tree.
+func getRefDirs(root string) ([]string, error) {
+	dirs := []string{}
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if !info.IsDir() {
+			return nil
+		}
+
+		if info.Name() == "remotes" && filepath.Base(filepath.Dir(path)) == "refs" {
+			return filepath.SkipDir
+		}
+
+		dirs = append(dirs, path)
+		return nil
+	})
+
+	return dirs, err
+}
+
+// isGitBusyFile tells if a change to the file in the git
+// directory means that a git operation is going on, i.e.,
+// it's the index or the lock of the index or HEAD.
+func isGitBusyFile(name string) bool {
+	switch name {
+	case "index", "index.lock", "HEAD.lock":
+		return true
+	}
+
+	return false
+}
+
+// isGitRefDir tells if the path is a directory, i.e., a new
+// namespace of refs like "refs/heads/feature/".
+func isGitRefDir(path string) bool {
+	isdir, err := isDir(path)
+	return err == nil && isdir
+}
@@ -0,0 +1,101 @@
+package leaf
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGitCheckoutIsCollapsed(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+
+	dir, err := ioutil.TempDir("", "leaf-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint:errcheck
+
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	git := func(args ...string) string {
+		cmd := exec.Command("git", args...) // nolint:gosec
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=leaf", "GIT_AUTHOR_EMAIL=leaf@example.com",
+			"GIT_COMMITTER_NAME=leaf", "GIT_COMMITTER_EMAIL=leaf@example.com")
+
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, out)
+		}
+
+		return strings.TrimSpace(string(out))
+	}
+
+	commit := func(content string) {
+		for _, name := range []string{"a.go", "b.go", "c.go"} {
+			path := filepath.Join(dir, name)
+			if err := ioutil.WriteFile(path, []byte(content+name), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		git("add", ".")
+		git("commit", "-q", "-m", content)
+	}
+
+	git("init", "-q")
+	commit("first")
+	first := git("rev-parse", "--abbrev-ref", "HEAD")
+	git("checkout", "-q", "-b", "second")
+	commit("second")
+
+	w, err := NewWatcherWithOptions(WatcherOptions{
+		Roots:     []WatchRoot{{Path: dir}},
+		Exclude:   []string{GitDir},
+		Git:       true,
+		GitSettle: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results := w.Watch(ctx)
+	want := fmt.Sprintf("%s %s", filepath.Join(dir, GitDir), OpRepo)
+
+	for i, branch := range []string{first, "second", first, "second"} {
+		git("checkout", "-q", branch)
+
+		got := []string{}
+		for done := false; !done; {
+			select {
+			case res := <-results:
+				if res.Err != nil {
+					t.Fatal(res.Err)
+				}
+				got = append(got, fmt.Sprintf("%s %s", res.File, res.Op))
+
+			case <-time.After(time.Second):
+				done = true
+			}
+		}
+
+		if len(got) != 1 || got[0] != want {
+			t.Errorf("checkout %d: got %v, want [%s]", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package leaf
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// splitPath splits the path into its segments. The leading
+// separator of an absolute path is dropped.
+func splitPath(path string) []string {
+	path = strings.Trim(filepath.ToSlash(path), "/")
+	if path == "" {
+		return []string{}
+	}
+
+	return strings.Split(path, "/")
+}
+
+// escapeGlob escapes the characters in the path that have a
+// special meaning in glob patterns.
+func escapeGlob(path string) string {
+	var b strings.Builder
+	for _, c := range path {
+		if strings.ContainsRune(`*?[\`, c) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+
+	return b.String()
+}
+
+// matchSegments matches the path segments against the pattern
+// segments. Each segment is matched using filepath.Match and
+// a "**" segment matches zero or more segments. A trailing
+// "**" matches everything inside, but not the directory
+// itself.
+func matchSegments(pattern, path []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			pattern = pattern[1:]
+			if len(pattern) == 0 {
+				return len(path) > 0
+			}
+
+			for i := 0; i <= len(path); i++ {
+				if matchSegments(pattern, path[i:]) {
+					return true
+				}
+			}
+
+			return false
+		}
+
+		if len(path) == 0 {
+			return false
+		}
+
+		matched, err := filepath.Match(pattern[0], path[0])
+		if err != nil || !matched {
+			return false
+		}
+
+		pattern, path = pattern[1:], path[1:]
+	}
+
+	return len(path) == 0
+}
+
+// matchSegmentsPrefix tells if the pattern segments match the
+// path segments or any of its parents.
+func matchSegmentsPrefix(pattern, path []string) bool {
+	for i := 1; i <= len(path); i++ {
+		if matchSegments(pattern, path[:i]) {
+			return true
+		}
+	}
+
+	return false
+}
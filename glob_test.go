@@ -0,0 +1,89 @@
+package leaf
+
+import (
+	"strings"
+	"testing"
+)
+
+// segments splits the slash separated path for the tests.
+func segments(path string) []string {
+	if path == "" {
+		return []string{}
+	}
+
+	return strings.Split(path, "/")
+}
+
+func TestMatchSegments(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		matched bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/b/c", false},
+		{"a/b/c", "a/b", false},
+		{"a/*", "a/b", true},
+		{"a/*", "a/b/c", false},
+		{"*.go", "main.go", true},
+		{"*.go", "main.txt", false},
+		{"a/?/c", "a/b/c", true},
+		{"a/[bc]", "a/c", true},
+		{"a/[", "a/[", false},
+
+		// "**" matches zero or more segments.
+		{"**/b", "b", true},
+		{"**/b", "a/b", true},
+		{"**/b", "a/x/y/b", true},
+		{"**/b", "a/b/c", false},
+		{"a/**/c", "a/c", true},
+		{"a/**/c", "a/b/c", true},
+		{"a/**/c", "a/b/d/c", true},
+		{"a/**/c", "a/b/d", false},
+		{"a/**/b/**/c", "a/x/b/y/z/c", true},
+
+		// A trailing "**" matches what's inside, not the
+		// directory itself.
+		{"a/**", "a/b", true},
+		{"a/**", "a/b/c", true},
+		{"a/**", "a", false},
+		{"**", "a", true},
+		{"**", "", false},
+	}
+
+	for _, tt := range tests {
+		got := matchSegments(segments(tt.pattern), segments(tt.path))
+		if got != tt.matched {
+			t.Errorf("matchSegments(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.matched)
+		}
+	}
+}
+
+func TestMatchSegmentsPrefix(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		matched bool
+	}{
+		{"r/a", "r/a", true},
+		{"r/a", "r/a/b/c.go", true},
+		{"r/a", "r/ab/c.go", false},
+		{"r/a", "r", false},
+		{"r/*/dist", "r/web/dist/app.js", true},
+		{"r/*/dist", "r/web/src/dist", false},
+		{"r/**/testdata", "r/testdata/x", true},
+		{"r/**/testdata", "r/a/b/testdata", true},
+		{"r/**/testdata", "r/a/b/testdatax/y", false},
+		{"r/**/*.go", "r/a/main.go", true},
+		{"r/**", "r", false},
+		{"r/**", "r/a", true},
+		{"r/a", "", false},
+	}
+
+	for _, tt := range tests {
+		got := matchSegmentsPrefix(segments(tt.pattern), segments(tt.path))
+		if got != tt.matched {
+			t.Errorf("matchSegmentsPrefix(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.matched)
+		}
+	}
+}
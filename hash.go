@@ -0,0 +1,142 @@
+package leaf
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// DefaultHashCacheSize is the number of files for which the
+// content hash is remembered when no size is specified.
+var DefaultHashCacheSize = 4096
+
+// DefaultHashMaxSize is the size in bytes above which the
+// files are not hashed when no size is specified.
+var DefaultHashMaxSize int64 = 4 << 20
+
+// errTooLarge occurs when the file is too large to be hashed.
+var errTooLarge = errors.New("file too large to hash")
+
+// hashCache remembers the content hashes of the files that
+// were changed recently. Hashes are computed only when a file
+// changes and the least recently changed files are forgotten
+// when the cache is full.
+type hashCache struct {
+	size    int
+	maxSize int64
+
+	mu    sync.Mutex
+	order *list.List
+	items map[string]*list.Element
+}
+
+// hashEntry is the content hash of a file.
+type hashEntry struct {
+	path string
+	sum  [sha256.Size]byte
+}
+
+// newHashCache creates a cache that remembers the hashes of
+// at most size files, hashing the files of at most maxSize
+// bytes.
+func newHashCache(size int, maxSize int64) *hashCache {
+	if size <= 0 {
+		size = DefaultHashCacheSize
+	}
+
+	if maxSize <= 0 {
+		maxSize = DefaultHashMaxSize
+	}
+
+	return &hashCache{
+		size:    size,
+		maxSize: maxSize,
+		order:   list.New(),
+		items:   map[string]*list.Element{},
+	}
+}
+
+// changed tells if the content of the file differs from the
+// last observed content. A file seen for the first time or
+// one that can't be read is always considered changed. So is
+// a file larger than the max size, since hashing it would
+// hold up the handling of the other events.
+func (c *hashCache) changed(path string) bool {
+	sum, err := hashFile(path, c.maxSize)
+	if err != nil {
+		c.forget(path)
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[path]; ok {
+		entry := e.Value.(*hashEntry) // nolint:errcheck
+		c.order.MoveToFront(e)
+
+		if entry.sum == sum {
+			return false
+		}
+
+		entry.sum = sum
+		return true
+	}
+
+	c.items[path] = c.order.PushFront(&hashEntry{path: path, sum: sum})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*hashEntry).path) // nolint:errcheck
+	}
+
+	return true
+}
+
+// forget removes the hash of the file from the cache.
+func (c *hashCache) forget(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[path]; ok {
+		c.order.Remove(e)
+		delete(c.items, path)
+	}
+}
+
+// hashFile returns the hash of the contents of the regular
+// file. Files larger than maxSize bytes aren't hashed unless
+// it's zero.
+func hashFile(path string, maxSize int64) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+
+	f, err := os.Open(path) // nolint:gosec
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close() // nolint:errcheck
+
+	info, err := f.Stat()
+	if err != nil {
+		return sum, err
+	}
+
+	if !info.Mode().IsRegular() {
+		return sum, os.ErrInvalid
+	}
+
+	if maxSize > 0 && info.Size() > maxSize {
+		return sum, errTooLarge
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, err
+	}
+
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
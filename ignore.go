@@ -0,0 +1,213 @@
+package leaf
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Names of the ignore files that can be read by the watcher.
+const (
+	GitIgnoreFile  = ".gitignore"
+	LeafIgnoreFile = ".leafignore"
+)
+
+// ignoreRule is a single pattern from an ignore file.
+type ignoreRule struct {
+	segments []string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// parseIgnoreRule parses a line of an ignore file written in
+// the gitignore syntax. Returns false if the line is blank or
+// a comment.
+func parseIgnoreRule(line string) (ignoreRule, bool) {
+	rule := ignoreRule{}
+
+	// Trailing spaces are ignored unless they are escaped.
+	line = strings.TrimRight(line, "\r")
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+
+	if line == "" || line[0] == '#' {
+		return rule, false
+	}
+
+	if line[0] == '!' {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	// A pattern with a separator at the beginning or in the
+	// middle is relative to the directory of the ignore file,
+	// else it matches the name at any depth.
+	if strings.Contains(line, "/") {
+		rule.anchored = true
+		line = strings.TrimLeft(line, "/")
+	}
+
+	if line == "" {
+		return rule, false
+	}
+
+	rule.segments = strings.Split(line, "/")
+	return rule, true
+}
+
+// match tells if the rule matches the path relative to the
+// directory of the ignore file.
+func (r ignoreRule) match(rel string, isdir bool) bool {
+	if r.dirOnly && !isdir {
+		return false
+	}
+
+	segments := strings.Split(filepath.ToSlash(rel), "/")
+	if !r.anchored {
+		segments = segments[len(segments)-1:]
+	}
+
+	return matchSegments(r.segments, segments)
+}
+
+// ignoreList has the rules from the ignore files found in the
+// watched directories. Rules from an ignore file apply to the
+// paths inside its directory, rules in deeper directories
+// take precedence and the last matching rule wins.
+type ignoreList struct {
+	files []string
+
+	mu    sync.RWMutex
+	rules map[string][]ignoreRule
+}
+
+// newIgnoreList creates an ignore list that reads the ignore
+// files with the given names.
+func newIgnoreList(files []string) *ignoreList {
+	return &ignoreList{
+		files: files,
+		rules: map[string][]ignoreRule{},
+	}
+}
+
+// isIgnoreFile tells if the path is one of the ignore files.
+func (l *ignoreList) isIgnoreFile(path string) bool {
+	name := filepath.Base(path)
+	for _, f := range l.files {
+		if f == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// load reads the ignore files in the directory, replacing the
+// rules read previously. Ignore files that can't be read are
+// skipped.
+func (l *ignoreList) load(dir string) {
+	if len(l.files) == 0 {
+		return
+	}
+
+	rules := []ignoreRule{}
+	for _, name := range l.files {
+		rules = append(rules, readIgnoreFile(filepath.Join(dir, name))...)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(rules) == 0 {
+		delete(l.rules, dir)
+		return
+	}
+
+	l.rules[dir] = rules
+}
+
+// isIgnored tells if the absolute path is ignored, either by
+// itself or because one of its parent directories is ignored.
+func (l *ignoreList) isIgnored(path string, isdir bool) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if len(l.rules) == 0 {
+		return false
+	}
+
+	if l.matchRules(path, isdir) {
+		return true
+	}
+
+	for dir := filepath.Dir(path); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if l.matchRules(dir, true) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchRules tells if the path is ignored by the rules of
+// the directories containing it.
+func (l *ignoreList) matchRules(path string, isdir bool) bool {
+	// Directories containing the path, the deepest first.
+	dirs := []string{}
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		if _, ok := l.rules[dir]; ok {
+			dirs = append(dirs, dir)
+		}
+
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+
+	ignored := false
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rel, err := filepath.Rel(dirs[i], path)
+		if err != nil {
+			continue
+		}
+
+		for _, rule := range l.rules[dirs[i]] {
+			if rule.match(rel, isdir) {
+				ignored = !rule.negate
+			}
+		}
+	}
+
+	return ignored
+}
+
+// readIgnoreFile reads the rules from the ignore file.
+func readIgnoreFile(path string) []ignoreRule {
+	rules := []ignoreRule{}
+
+	f, err := os.Open(path) // nolint:gosec
+	if err != nil {
+		return rules
+	}
+	defer f.Close() // nolint:errcheck
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if rule, ok := parseIgnoreRule(scanner.Text()); ok {
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules
+}
@@ -0,0 +1,119 @@
+package leaf
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseIgnoreRule(t *testing.T) {
+	tests := []struct {
+		line string
+		rule ignoreRule
+		ok   bool
+	}{
+		{line: "", ok: false},
+		{line: "   ", ok: false},
+		{line: "# comment", ok: false},
+		{line: "/", ok: false},
+		{line: "*.log", rule: ignoreRule{segments: []string{"*.log"}}, ok: true},
+		{line: "*.log  ", rule: ignoreRule{segments: []string{"*.log"}}, ok: true},
+		{line: `name\ `, rule: ignoreRule{segments: []string{`name\ `}}, ok: true},
+		{line: `\#name`, rule: ignoreRule{segments: []string{"#name"}}, ok: true},
+		{line: `\!name`, rule: ignoreRule{segments: []string{"!name"}}, ok: true},
+		{line: "!keep.log", rule: ignoreRule{segments: []string{"keep.log"}, negate: true}, ok: true},
+		{line: "build/", rule: ignoreRule{segments: []string{"build"}, dirOnly: true}, ok: true},
+		{line: "/build", rule: ignoreRule{segments: []string{"build"}, anchored: true}, ok: true},
+		{
+			line: "docs/**/*.tmp",
+			rule: ignoreRule{segments: []string{"docs", "**", "*.tmp"}, anchored: true},
+			ok:   true,
+		},
+		{
+			line: "!/out/",
+			rule: ignoreRule{segments: []string{"out"}, negate: true, dirOnly: true, anchored: true},
+			ok:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		rule, ok := parseIgnoreRule(tt.line)
+		if ok != tt.ok {
+			t.Errorf("parseIgnoreRule(%q) ok = %v, want %v", tt.line, ok, tt.ok)
+			continue
+		}
+
+		if ok && !reflect.DeepEqual(rule, tt.rule) {
+			t.Errorf("parseIgnoreRule(%q) = %+v, want %+v", tt.line, rule, tt.rule)
+		}
+	}
+}
+
+func TestIgnoreListIsIgnored(t *testing.T) {
+	rules := func(lines ...string) []ignoreRule {
+		parsed := []ignoreRule{}
+		for _, line := range lines {
+			if rule, ok := parseIgnoreRule(line); ok {
+				parsed = append(parsed, rule)
+			}
+		}
+
+		return parsed
+	}
+
+	l := newIgnoreList([]string{GitIgnoreFile})
+	l.rules["/r"] = rules(
+		"*.log",
+		"!keep.log",
+		"build/",
+		"/only-top",
+		"docs/**/*.tmp",
+	)
+	l.rules["/r/sub"] = rules("!*.log", "local/")
+
+	tests := []struct {
+		path    string
+		isdir   bool
+		ignored bool
+	}{
+		{"/r/main.go", false, false},
+		{"/r/a.log", false, true},
+		{"/r/x/y/a.log", false, true},
+
+		// Negation.
+		{"/r/keep.log", false, false},
+		{"/r/x/keep.log", false, false},
+
+		// Only directories.
+		{"/r/build", true, true},
+		{"/r/build", false, false},
+		{"/r/x/build", true, true},
+
+		// Inside an ignored directory, even if negated.
+		{"/r/build/out.o", false, true},
+		{"/r/build/keep.log", false, true},
+
+		// Anchored to the directory of the ignore file.
+		{"/r/only-top", false, true},
+		{"/r/x/only-top", false, false},
+
+		// "**" matches zero or more directories.
+		{"/r/docs/a.tmp", false, true},
+		{"/r/docs/a/b/c.tmp", false, true},
+		{"/r/x/docs/a.tmp", false, false},
+
+		// Rules of nested ignore files take precedence.
+		{"/r/sub/a.log", false, false},
+		{"/r/sub/x/a.log", false, false},
+		{"/r/sub/local", true, true},
+		{"/r/local", true, false},
+
+		// Rules don't apply outside their directory.
+		{"/other/a.log", false, false},
+	}
+
+	for _, tt := range tests {
+		if got := l.isIgnored(tt.path, tt.isdir); got != tt.ignored {
+			t.Errorf("isIgnored(%q, %v) = %v, want %v", tt.path, tt.isdir, got, tt.ignored)
+		}
+	}
+}
@@ -82,6 +82,7 @@ import (
 	"os/signal"
 	"path/filepath"
 	"runtime/debug"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -106,6 +107,17 @@ var (
 		"vendor/",
 		"venv/",
 	}
+
+	// DefaultEvents are the events that trigger the commands
+	// when none are specified.
+	DefaultEvents = []string{
+		"create",
+		"write",
+		"remove",
+		"rename",
+		"repo",
+	}
+
 	// ImportPath is the import path for leaf package.
 	ImportPath = "github.com/vrongmeal/leaf"
 )
@@ -122,29 +134,121 @@ func init() {
 
 // Config represents the conf file for the runner.
 type Config struct {
-	// Root directory to watch.
-	Root string `mapstructure:"root"`
+	// Root directories to watch.
+	Root []string `mapstructure:"root"`
+
+	// FollowSymlinks watches the directories that symbolic
+	// links inside the root directories point to.
+	FollowSymlinks bool `mapstructure:"follow_symlinks"`
 
-	// Exclude these directories from watch.
+	// Files to watch in addition to the root directories.
+	// These can be outside the root directories.
+	Files []string `mapstructure:"files"`
+
+	// Exclude these directories from watch. Relative paths
+	// are excluded in each of the root directories. These can
+	// be glob patterns like "**/testdata".
 	Exclude []string `mapstructure:"exclude"`
 
+	// Gitignore uses the .gitignore files in the watched
+	// directories to ignore paths. Paths listed in the
+	// .leafignore files are always ignored.
+	Gitignore bool `mapstructure:"gitignore"`
+
 	// Filters to apply to the watch.
 	Filters []string `mapstructure:"filters"`
 
+	// FilterHandler decides how the filters are evaluated,
+	// i.e., "standard" (excludes always win) or "ordered" (the
+	// last matching filter wins).
+	FilterHandler string `mapstructure:"filter_handler"`
+
+	// Events (operations on files) that trigger the commands,
+	// i.e., "create", "write", "remove", "rename", "chmod" or
+	// "repo" (change of the state of the git repository).
+	Events []string `mapstructure:"events"`
+
+	// Git watches the state of the git repository and reports
+	// the changes made by git operations, like a checkout or
+	// a commit, as a single "repo" event.
+	Git bool `mapstructure:"git"`
+
+	// Backend used to watch for changes, i.e., "fsnotify"
+	// (default) or "poll".
+	Backend string `mapstructure:"backend"`
+
+	// PollInterval is the interval after which the poll
+	// backend checks for changes.
+	PollInterval time.Duration `mapstructure:"poll_interval"`
+
+	// Hash the contents of changed files and ignore the writes
+	// that don't change the content.
+	Hash bool `mapstructure:"hash"`
+
+	// HashCacheSize is the number of files for which the
+	// content hash is remembered.
+	HashCacheSize int `mapstructure:"hash_cache_size"`
+
+	// PollOnLimit polls the directories that can't be watched
+	// because the limit of watches set by the kernel is reached
+	// instead of exiting.
+	PollOnLimit bool `mapstructure:"poll_on_limit"`
+
+	// SinceLastRun compares the files with the snapshot of
+	// the last run at start and runs the commands only if any
+	// of the files changed.
+	SinceLastRun bool `mapstructure:"since_last_run"`
+
+	// StateDir is the directory where the state (snapshot)
+	// is stored between runs.
+	StateDir string `mapstructure:"state_dir"`
+
+	// RescanOnOverflow scans the directories again when the
+	// events overflow so that no change is lost.
+	RescanOnOverflow bool `mapstructure:"rescan_on_overflow"`
+
+	// BufferSize is the number of events buffered while the
+	// commands are being run.
+	BufferSize int `mapstructure:"buffer_size"`
+
+	// OverflowPolicy decides what happens to an event when
+	// the buffer is full, i.e., "block", "drop-newest",
+	// "drop-oldest" or "coalesce".
+	OverflowPolicy string `mapstructure:"overflow_policy"`
+
 	// Exec these commads after changes detected.
 	Exec []string `mapstructure:"exec"`
 
 	// ExitOnErr breaks the chain of command if any command returnns an error.
 	ExitOnErr bool `mapstructure:"exit_on_err"`
 
-	// Delay after which commands should be executed.
+	// Delay after the last change after which commands should
+	// be executed. Every change during the delay restarts it.
 	Delay time.Duration `mapstructure:"delay"`
+
+	// MaxDelay is the maximum delay after the first change
+	// after which the commands are executed even if changes
+	// keep occurring. There's no limit if it's zero.
+	MaxDelay time.Duration `mapstructure:"max_delay"`
+
+	// StormThreshold is the number of events per StormInterval
+	// above which the commands are paused until the rate of
+	// events stays below it for StormCooldown. The commands
+	// are never paused if it's zero.
+	StormThreshold int           `mapstructure:"storm_threshold"`
+	StormInterval  time.Duration `mapstructure:"storm_interval"`
+	StormCooldown  time.Duration `mapstructure:"storm_cooldown"`
+
+	// Record the events, the filter decisions and the runs of
+	// the commands to this file (as JSON lines) so that the
+	// session can be replayed.
+	Record string `mapstructure:"record"`
 }
 
 // NewCmdContext returns a context which cancels on an OS
 // interrupt, i.e., cancels when process is killed.
 func NewCmdContext(onInterrupt func(os.Signal)) context.Context {
-	interrupt := make(chan os.Signal)
+	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
 	ctx, cancel := context.WithCancel(context.Background())
 
@@ -176,6 +280,21 @@ func GoModuleInfo() (*debug.Module, error) {
 
 // *** some helper functions ***
 
+// expandHome replaces the "~" at the beginning of the path
+// with the home directory of the user.
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~"+string(filepath.Separator)) {
+		return path, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, path[1:]), nil
+}
+
 // isDir checks if the given path is a directory or not.
 // Returns an error when path is invalid.
 func isDir(root string) (bool, error) {
@@ -0,0 +1,172 @@
+package leaf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Paths of the files with the inotify limits of the kernel.
+const (
+	maxUserWatchesPath   = "/proc/sys/fs/inotify/max_user_watches"
+	maxUserInstancesPath = "/proc/sys/fs/inotify/max_user_instances"
+)
+
+// numLargestSubtrees is the number of largest subtrees listed
+// in the watch limit error.
+const numLargestSubtrees = 5
+
+// Subtree is a directory along-with the number of directories
+// inside it (including itself).
+type Subtree struct {
+	Path string
+	Dirs int
+}
+
+// WatchLimitError occurs when the directories to watch exceed
+// the limit of watches set by the kernel, i.e.,
+// `fs.inotify.max_user_watches` on linux.
+type WatchLimitError struct {
+	// Dirs is the number of directories the watcher tried to
+	// watch.
+	Dirs int
+
+	// Watched is the number of directories watched before the
+	// limit was reached.
+	Watched int
+
+	// MaxUserWatches and MaxUserInstances are the limits set by
+	// the kernel. These are zero if the limits can't be read.
+	MaxUserWatches   int
+	MaxUserInstances int
+
+	// Largest are the largest subtrees that can be excluded
+	// to reduce the number of directories to watch.
+	Largest []Subtree
+
+	// Err is the error returned when adding the watch.
+	Err error
+}
+
+// Error returns the error message with the diagnostics.
+func (e *WatchLimitError) Error() string {
+	msg := fmt.Sprintf(
+		"watch limit reached: tried to watch %d directories, watched %d",
+		e.Dirs, e.Watched)
+
+	if e.MaxUserWatches > 0 {
+		msg += fmt.Sprintf(
+			" (fs.inotify.max_user_watches = %d, fs.inotify.max_user_instances = %d)",
+			e.MaxUserWatches, e.MaxUserInstances)
+	}
+
+	if len(e.Largest) > 0 {
+		subtrees := []string{}
+		for _, s := range e.Largest {
+			subtrees = append(subtrees, fmt.Sprintf("'%s' (%d)", s.Path, s.Dirs))
+		}
+
+		msg += "; consider excluding the largest subtrees: " +
+			strings.Join(subtrees, ", ")
+	}
+
+	return fmt.Sprintf("%s: %v", msg, e.Err)
+}
+
+// Unwrap returns the error returned when adding the watch.
+func (e *WatchLimitError) Unwrap() error {
+	return e.Err
+}
+
+// newWatchLimitError creates the error with the diagnostics
+// for the directories that were to be watched.
+func newWatchLimitError(err error, dirs []string, watched int, roots []string) *WatchLimitError {
+	return &WatchLimitError{
+		Dirs:             len(dirs),
+		Watched:          watched,
+		MaxUserWatches:   readLimit(maxUserWatchesPath),
+		MaxUserInstances: readLimit(maxUserInstancesPath),
+		Largest:          largestSubtrees(dirs, roots, numLargestSubtrees),
+		Err:              err,
+	}
+}
+
+// isWatchLimitErr tells if the error occurred because the
+// limit of watches is reached.
+func isWatchLimitErr(err error) bool {
+	return err == syscall.ENOSPC
+}
+
+// readLimit reads the integer limit from the file. Returns
+// zero if the limit can't be read.
+func readLimit(path string) int {
+	content, err := ioutil.ReadFile(path) // nolint:gosec
+	if err != nil {
+		return 0
+	}
+
+	limit, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0
+	}
+
+	return limit
+}
+
+// largestSubtrees returns at most n largest subtrees of the
+// directories, excluding the roots. A subtree inside one
+// that is already listed is not listed again.
+func largestSubtrees(dirs, roots []string, n int) []Subtree {
+	isRoot := map[string]bool{}
+	for _, r := range roots {
+		isRoot[r] = true
+	}
+
+	counts := map[string]int{}
+	for _, dir := range dirs {
+		for d := dir; !isRoot[d]; d = filepath.Dir(d) {
+			counts[d]++
+			if d == filepath.Dir(d) {
+				break
+			}
+		}
+	}
+
+	subtrees := make([]Subtree, 0, len(counts))
+	for path, count := range counts {
+		subtrees = append(subtrees, Subtree{Path: path, Dirs: count})
+	}
+
+	sort.Slice(subtrees, func(i, j int) bool {
+		if subtrees[i].Dirs != subtrees[j].Dirs {
+			return subtrees[i].Dirs > subtrees[j].Dirs
+		}
+
+		return subtrees[i].Path < subtrees[j].Path
+	})
+
+	largest := []Subtree{}
+	for _, s := range subtrees {
+		if len(largest) == n {
+			break
+		}
+
+		nested := false
+		for _, l := range largest {
+			if hasPathPrefix(s.Path, l.Path) {
+				nested = true
+				break
+			}
+		}
+
+		if !nested {
+			largest = append(largest, s)
+		}
+	}
+
+	return largest
+}
@@ -0,0 +1,64 @@
+package leaf
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLargestSubtrees(t *testing.T) {
+	dirs := []string{
+		"/r",
+		"/r/a",
+		"/r/a/x",
+		"/r/a/y",
+		"/r/a/y/z",
+		"/r/b",
+		"/r/b/x",
+		"/r/c",
+	}
+
+	tests := []struct {
+		name  string
+		roots []string
+		n     int
+		want  []Subtree
+	}{
+		{
+			name:  "nested subtrees skipped",
+			roots: []string{"/r"},
+			n:     3,
+			want:  []Subtree{{"/r/a", 4}, {"/r/b", 2}, {"/r/c", 1}},
+		},
+		{
+			name:  "at most n",
+			roots: []string{"/r"},
+			n:     1,
+			want:  []Subtree{{"/r/a", 4}},
+		},
+		{
+			name:  "fewer than n",
+			roots: []string{"/r"},
+			n:     10,
+			want:  []Subtree{{"/r/a", 4}, {"/r/b", 2}, {"/r/c", 1}},
+		},
+		{
+			name:  "nested roots not listed",
+			roots: []string{"/r", "/r/b"},
+			n:     5,
+			want:  []Subtree{{"/r/a", 4}, {"/r/b/x", 1}, {"/r/c", 1}},
+		},
+		{
+			name:  "none",
+			roots: []string{"/r"},
+			n:     0,
+			want:  []Subtree{},
+		},
+	}
+
+	for _, tt := range tests {
+		got := largestSubtrees(dirs, tt.roots, tt.n)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package leaf
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RecordKind is the kind of an entry in the recording of a
+// watch session.
+type RecordKind string
+
+// The kinds of entries in a recording.
+const (
+	// RecordEvent is a raw event from the backend.
+	RecordEvent RecordKind = "event"
+
+	// RecordFilter is the decision whether the change in the
+	// preceding event passes the excludes, ignores, filters and
+	// content hashing of the watcher.
+	RecordFilter RecordKind = "filter"
+
+	// RecordResult is a change reported by the watcher, i.e.,
+	// a change that passed the filters and wasn't collapsed
+	// into a git operation or the change of the repository
+	// for a git operation.
+	RecordResult RecordKind = "result"
+
+	// RecordTrigger is a run of the commands for the files.
+	RecordTrigger RecordKind = "trigger"
+
+	// RecordError is an error reported by the watcher.
+	RecordError RecordKind = "error"
+)
+
+// Record is an entry in the recording of a watch session.
+// The recordings are stored as JSON lines.
+type Record struct {
+	Time    time.Time  `json:"time"`
+	Kind    RecordKind `json:"kind"`
+	File    string     `json:"file,omitempty"`
+	Op      string     `json:"op,omitempty"`
+	Handled bool       `json:"handled,omitempty"`
+	Files   []string   `json:"files,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// Recorder writes the entries of a watch session, so that the
+// session can be replayed later.
+type Recorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+
+	// path of the file written to, if it's a file.
+	path string
+}
+
+// NewRecorder creates a recorder that writes the entries to
+// the writer as JSON lines. If the writer is a file, the
+// changes to the file aren't recorded (or reported) by the
+// watcher, which would otherwise record its own writes
+// forever when the file is inside a root.
+func NewRecorder(w io.Writer) *Recorder {
+	r := &Recorder{enc: json.NewEncoder(w)}
+
+	if f, ok := w.(*os.File); ok {
+		if path, err := filepath.Abs(f.Name()); err == nil {
+			r.path = path
+		}
+	}
+
+	return r
+}
+
+// isRecording tells if the path is the file the entries are
+// written to.
+func (r *Recorder) isRecording(path string) bool {
+	return r.path != "" && r.path == path
+}
+
+// Record writes the entry. The time of the entry is set to
+// the current time if not set.
+func (r *Recorder) Record(rec Record) error {
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.enc.Encode(rec)
+}
+
+// ReadRecords reads the entries of a recorded watch session.
+func ReadRecords(r io.Reader) ([]Record, error) {
+	records := []Record{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var rec Record
+		if err := json.Unmarshal([]byte(text), &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		records = append(records, rec)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// Replayer streams the results of a recorded watch session,
+// i.e., the changes and errors reported by the watcher, so
+// that the session can be reproduced.
+//
+// The results are streamed with the timing they were recorded
+// with, which can be sped up and whose long pauses can be cut
+// short. The pauses longer than the delay of the batcher all
+// have the same effect, so a max gap a bit longer than the
+// delay reproduces the batches of the session.
+type Replayer struct {
+	// Speed is the factor by which the replay is faster than
+	// the session. The session's speed is used if it's zero.
+	Speed float64
+
+	// MaxGap is the longest pause between two results. There's
+	// no limit if it's zero.
+	MaxGap time.Duration
+
+	// Roots are the root directories of the session with
+	// their filters. A result is filtered by the filters of
+	// the innermost root it's in, like by the watcher, and by
+	// the filters given to Replay if none.
+	Roots []WatchRoot
+}
+
+// NewReplayer creates a new replayer.
+func NewReplayer(replayer Replayer) *Replayer {
+	r := &Replayer{
+		Speed:  replayer.Speed,
+		MaxGap: replayer.MaxGap,
+	}
+
+	for _, root := range replayer.Roots {
+		root.Path = filepath.Clean(root.Path)
+		r.Roots = append(r.Roots, root)
+	}
+
+	if r.Speed <= 0 {
+		r.Speed = 1
+	}
+
+	return r
+}
+
+// Replay streams the results of the recorded session with the
+// speed of the session.
+func Replay(ctx context.Context, records []Record, fc *FilterCollection) <-chan WatchResult {
+	return NewReplayer(Replayer{}).Replay(ctx, records, fc)
+}
+
+// Replay streams the recorded results that pass the filters
+// of their root, or the given ones if they aren't in any root
+// (all of them if the filters are nil). Like for a
+// subscriber, errors and changes of the state of a repository
+// are always streamed. The stream is closed when all the
+// results are streamed or the context is canceled.
+//
+// Recordings without the results, from older versions, are
+// replayed from the filter decisions instead, i.e., without
+// the git operations collapsed.
+func (r *Replayer) Replay(ctx context.Context, records []Record, fc *FilterCollection) <-chan WatchResult {
+	results := make(chan WatchResult)
+
+	kind := RecordFilter
+	for _, rec := range records {
+		if rec.Kind == RecordResult {
+			kind = RecordResult
+			break
+		}
+	}
+
+	go func() {
+		defer close(results)
+
+		var last time.Time
+		for _, rec := range records {
+			if !isReplayed(rec, kind) {
+				continue
+			}
+
+			if !last.IsZero() && rec.Time.After(last) {
+				select {
+				case <-time.After(r.gap(rec.Time.Sub(last))):
+				case <-ctx.Done():
+					return
+				}
+			}
+			last = rec.Time
+
+			res := WatchResult{File: rec.File}
+			if rec.Kind == RecordError {
+				res.Err = errors.New(rec.Error)
+			} else {
+				op, err := parseOpString(rec.Op)
+				if err != nil {
+					res = WatchResult{Err: err}
+				} else if op != OpRepo && !r.shouldHandle(rec.File, op, fc) {
+					continue
+				}
+				res.Op = op
+			}
+
+			select {
+			case results <- res:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return results
+}
+
+// shouldHandle tells if the change passes the filters of the
+// innermost root that contains the file, or fc if there's none.
+func (r *Replayer) shouldHandle(path string, op Op, fc *FilterCollection) bool {
+	var found *WatchRoot
+	for i, root := range r.Roots {
+		if path != root.Path && !hasPathPrefix(path, root.Path) {
+			continue
+		}
+
+		if found == nil || len(root.Path) > len(found.Path) {
+			found = &r.Roots[i]
+		}
+	}
+
+	if found != nil && found.Filters != nil {
+		fc = found.Filters
+	}
+
+	return fc == nil || fc.ShouldHandleEvent(NewFileEvent(path, op))
+}
+
+// isReplayed tells if the entry is replayed when the changes
+// are replayed from the entries of the given kind.
+func isReplayed(rec Record, kind RecordKind) bool {
+	switch rec.Kind {
+	case RecordError:
+		return true
+
+	case RecordResult:
+		return kind == RecordResult
+
+	case RecordFilter:
+		return kind == RecordFilter && rec.Handled
+	}
+
+	return false
+}
+
+// gap returns the pause to replay for the recorded one.
+func (r *Replayer) gap(recorded time.Duration) time.Duration {
+	gap := time.Duration(float64(recorded) / r.Speed)
+	if r.MaxGap > 0 && gap > r.MaxGap {
+		gap = r.MaxGap
+	}
+
+	return gap
+}
+
+// parseOpString parses the operations in the format of
+// Op.String, like `create|write`.
+func parseOpString(s string) (Op, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	return ParseOps(strings.Split(s, "|"))
+}
+
+// isRecording tells if the path is the file that the
+// recorder of the watcher writes to.
+func (w *Watcher) isRecording(path string) bool {
+	return w.recorder != nil && w.recorder.isRecording(path)
+}
+
+// record writes the entry to the recorder of the watcher,
+// if any.
+func (w *Watcher) record(rec Record) {
+	if w.recorder != nil {
+		w.recorder.Record(rec) // nolint:errcheck
+	}
+}
@@ -0,0 +1,126 @@
+package leaf
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRecordingInsideRootIsNotWatched(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leaf-record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint:errcheck
+
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recording := filepath.Join(dir, "events.jsonl")
+	f, err := os.Create(recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close() // nolint:errcheck
+
+	w, err := NewWatcherWithOptions(WatcherOptions{
+		Roots:    []WatchRoot{{Path: dir}},
+		Recorder: NewRecorder(f),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results := w.Watch(ctx)
+
+	file := filepath.Join(dir, "a.go")
+	if err := ioutil.WriteFile(file, []byte("package a\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for timeout := time.After(time.Second); ; {
+		select {
+		case res := <-results:
+			if res.Err != nil {
+				t.Fatal(res.Err)
+			}
+
+			if res.File != file {
+				t.Errorf("got the change to '%s', want only the ones to '%s'", res.File, file)
+			}
+			continue
+
+		case <-timeout:
+		}
+
+		break
+	}
+
+	content, err := ioutil.ReadFile(recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An event, a filter decision and a result for each of the
+	// few events on the file.
+	if lines := bytes.Count(content, []byte("\n")); lines == 0 || lines > 20 {
+		t.Errorf("recorded %d entries, want a few for the change to a.go", lines)
+	}
+}
+
+func TestReplayFiltersByRoot(t *testing.T) {
+	goOnly, err := NewFCFromPatternsRelativeTo([]string{"+ *.go"}, "/a",
+		StandardFilterMatcher, StandardFilterHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	noGen, err := NewFCFromPatternsRelativeTo([]string{"- gen/"}, "/b",
+		StandardFilterMatcher, StandardFilterHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReplayer(Replayer{
+		Roots: []WatchRoot{
+			{Path: "/a", Filters: goOnly},
+			{Path: "/b", Filters: noGen},
+		},
+	})
+
+	var records []Record
+	for _, file := range []string{
+		"/a/main.go",
+		"/a/README.md",
+		"/b/README.md",
+		"/b/gen/api.go",
+		"/b/main.go",
+		"/c/README.md",
+	} {
+		records = append(records, Record{Kind: RecordResult, File: file, Op: OpWrite.String()})
+	}
+
+	got := []string{}
+	for res := range r.Replay(context.Background(), records, nil) {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		got = append(got, res.File)
+	}
+
+	// Files outside the roots aren't filtered.
+	want := []string{"/a/main.go", "/b/README.md", "/b/main.go", "/c/README.md"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,73 @@
+package leaf
+
+import (
+	"os"
+)
+
+// recordState records the state of the files so that the
+// changes can be found when the events overflow.
+func (w *Watcher) recordState() {
+	state, err := w.Snapshot(false)
+	if err != nil {
+		w.res <- WatchResult{Err: err}
+		return
+	}
+
+	w.state = state
+}
+
+// updateState updates the recorded state of the file after an
+// event on it.
+func (w *Watcher) updateState(path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		delete(w.state.Files, path)
+		return
+	}
+
+	if info.IsDir() {
+		return
+	}
+
+	w.state.Files[path] = FileState{
+		ModTime: info.ModTime(),
+		Size:    info.Size(),
+	}
+}
+
+// rescan syncs the watched directories with the file system
+// and streams the changes to the files since the recorded
+// state.
+func (w *Watcher) rescan() {
+	w.mu.Lock()
+	dirs := []string{}
+	for dir := range w.paths {
+		dirs = append(dirs, dir)
+	}
+	w.mu.Unlock()
+
+	for _, dir := range dirs {
+		if isdir, err := isDir(dir); err != nil || !isdir {
+			w.removeDirs(dir)
+		}
+	}
+
+	for _, root := range w.rootPaths() {
+		if err := w.addDirs(root); err != nil {
+			w.res <- WatchResult{Err: err}
+		}
+	}
+
+	current, err := w.Snapshot(false)
+	if err != nil {
+		w.res <- WatchResult{Err: err}
+		return
+	}
+
+	changes := w.state.Diff(current)
+	w.state = current
+
+	for _, c := range changes {
+		w.reportChange(c.File, c.Op)
+	}
+}
@@ -0,0 +1,194 @@
+package leaf
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// DefaultStateDir is the directory, relative to the working
+// directory, where leaf stores its state between sessions.
+var DefaultStateDir = ".leaf"
+
+// SnapshotFile is the name of the file in the state directory
+// that stores the snapshot of the last session.
+const SnapshotFile = "snapshot.json"
+
+// FileState is the state of a file recorded in a snapshot.
+type FileState struct {
+	ModTime time.Time `json:"mtime"`
+	Size    int64     `json:"size"`
+	Hash    string    `json:"hash,omitempty"`
+}
+
+// Snapshot is the state of all the watched files at a point
+// in time. It's used to find the changes that occurred while
+// the files were not being watched.
+type Snapshot struct {
+	Time  time.Time            `json:"time"`
+	Files map[string]FileState `json:"files"`
+}
+
+// LoadSnapshot reads the snapshot from the file.
+func LoadSnapshot(path string) (*Snapshot, error) {
+	content, err := ioutil.ReadFile(path) // nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Snapshot{}
+	if err := json.Unmarshal(content, s); err != nil {
+		return nil, err
+	}
+
+	if s.Files == nil {
+		s.Files = map[string]FileState{}
+	}
+
+	return s, nil
+}
+
+// Save writes the snapshot to the file, creating the parent
+// directories if required.
+func (s *Snapshot) Save(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file and move it so that an
+	// interrupted write doesn't corrupt the last snapshot.
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// Diff returns the changes from the snapshot to the newer
+// one, sorted by the file path. Files whose modification time
+// or size differ are reported as written, unless both the
+// snapshots have the content hash which is the same.
+func (s *Snapshot) Diff(newer *Snapshot) []Change {
+	changes := []Change{}
+
+	for path, state := range newer.Files {
+		old, ok := s.Files[path]
+
+		switch {
+		case !ok:
+			changes = append(changes, Change{File: path, Op: OpCreate})
+
+		case old.Hash != "" && state.Hash != "":
+			if old.Hash != state.Hash {
+				changes = append(changes, Change{File: path, Op: OpWrite})
+			}
+
+		case !old.ModTime.Equal(state.ModTime) || old.Size != state.Size:
+			changes = append(changes, Change{File: path, Op: OpWrite})
+		}
+	}
+
+	for path := range s.Files {
+		if _, ok := newer.Files[path]; !ok {
+			changes = append(changes, Change{File: path, Op: OpRemove})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].File < changes[j].File
+	})
+
+	return changes
+}
+
+// Snapshot records the state of all the files in the watched
+// directories (and the individually watched files) that are
+// not ignored. The content of every file is hashed if hash
+// is true.
+func (w *Watcher) Snapshot(hash bool) (*Snapshot, error) {
+	w.mu.Lock()
+	dirs := []string{}
+	for dir := range w.paths {
+		dirs = append(dirs, dir)
+	}
+
+	files := []string{}
+	for file := range w.files {
+		files = append(files, file)
+	}
+	w.mu.Unlock()
+
+	s := &Snapshot{
+		Time:  time.Now(),
+		Files: map[string]FileState{},
+	}
+
+	record := func(path string, info os.FileInfo) {
+		state := FileState{
+			ModTime: info.ModTime(),
+			Size:    info.Size(),
+		}
+
+		if hash {
+			if sum, err := hashFile(path, 0); err == nil {
+				state.Hash = hex.EncodeToString(sum[:])
+			}
+		}
+
+		s.Files[path] = state
+	}
+
+	for _, dir := range dirs {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			// The directory might have been removed already.
+			continue
+		}
+
+		for _, info := range infos {
+			path := filepath.Join(dir, info.Name())
+			if info.IsDir() || w.isIgnored(path) {
+				continue
+			}
+
+			record(path, info)
+		}
+	}
+
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil && !info.IsDir() {
+			record(file, info)
+		}
+	}
+
+	return s, nil
+}
+
+// ChangesSince returns the changes to the files since the
+// given snapshot, e.g., from the last session, that pass the
+// filters. It also returns the current snapshot.
+func (w *Watcher) ChangesSince(prev *Snapshot, hash bool) (ChangeSet, *Snapshot, error) {
+	current, err := w.Snapshot(hash)
+	if err != nil {
+		return ChangeSet{}, nil, err
+	}
+
+	cs := ChangeSet{}
+	for _, c := range prev.Diff(current) {
+		if w.shouldReport(c.File, c.Op) {
+			cs.Changes = append(cs.Changes, c)
+		}
+	}
+
+	return cs, current, nil
+}
@@ -0,0 +1,53 @@
+package leaf
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSnapshotDiff(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	t1 := t0.Add(time.Minute)
+
+	older := &Snapshot{Files: map[string]FileState{
+		"/r/same.go":      {ModTime: t0, Size: 10},
+		"/r/touched.go":   {ModTime: t0, Size: 10},
+		"/r/resized.go":   {ModTime: t0, Size: 10},
+		"/r/removed.go":   {ModTime: t0, Size: 10},
+		"/r/hashed.go":    {ModTime: t0, Size: 10, Hash: "aa"},
+		"/r/rehashed.go":  {ModTime: t0, Size: 10, Hash: "aa"},
+		"/r/half-hash.go": {ModTime: t0, Size: 10},
+	}}
+
+	newer := &Snapshot{Files: map[string]FileState{
+		"/r/same.go":    {ModTime: t0, Size: 10},
+		"/r/touched.go": {ModTime: t1, Size: 10},
+		"/r/resized.go": {ModTime: t0, Size: 20},
+		"/r/created.go": {ModTime: t1, Size: 10},
+
+		// Same content although touched.
+		"/r/hashed.go":   {ModTime: t1, Size: 10, Hash: "aa"},
+		"/r/rehashed.go": {ModTime: t0, Size: 10, Hash: "bb"},
+
+		// Hashes are compared only if both have them.
+		"/r/half-hash.go": {ModTime: t1, Size: 10, Hash: "aa"},
+	}}
+
+	want := []Change{
+		{File: "/r/created.go", Op: OpCreate},
+		{File: "/r/half-hash.go", Op: OpWrite},
+		{File: "/r/rehashed.go", Op: OpWrite},
+		{File: "/r/removed.go", Op: OpRemove},
+		{File: "/r/resized.go", Op: OpWrite},
+		{File: "/r/touched.go", Op: OpWrite},
+	}
+
+	if got := older.Diff(newer); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if got := newer.Diff(newer); len(got) != 0 {
+		t.Errorf("got %v for the same snapshot, want no changes", got)
+	}
+}
@@ -0,0 +1,197 @@
+package leaf
+
+import (
+	"context"
+	"time"
+)
+
+var (
+	// DefaultStormInterval is the interval over which the
+	// rate of events is measured.
+	DefaultStormInterval = time.Second
+
+	// DefaultStormCooldown is the duration for which the rate
+	// of events should stay below the threshold for the
+	// stream to resume.
+	DefaultStormCooldown = 5 * time.Second
+)
+
+// StormBreaker pauses the stream of watch results during an
+// event storm, like a generator gone haywire writing thousands
+// of files, so that the commands aren't restarted forever.
+//
+// The stream is paused as soon as the number of events in an
+// interval exceeds the threshold and resumes once the rate
+// stays at or below the threshold for the cooldown duration.
+// The changes held during the pause are streamed (one result
+// per file) when the stream resumes.
+type StormBreaker struct {
+	// Threshold is the number of events per interval above
+	// which the stream is paused. The stream is never paused
+	// if it's zero.
+	Threshold int
+
+	// Interval over which the rate of events is measured.
+	Interval time.Duration
+
+	// Cooldown is the duration for which the rate should stay
+	// at or below the threshold for the stream to resume.
+	Cooldown time.Duration
+
+	// OnTrip is called with the number of events in the
+	// interval when the stream is paused.
+	OnTrip func(events int, interval time.Duration)
+
+	// OnResume is called with the number of files changed
+	// during the pause when the stream resumes.
+	OnResume func(held int)
+}
+
+// NewStormBreaker creates a new storm breaker. The interval
+// and cooldown default to DefaultStormInterval and
+// DefaultStormCooldown.
+func NewStormBreaker(breaker StormBreaker) *StormBreaker {
+	b := &StormBreaker{
+		Threshold: breaker.Threshold,
+		Interval:  breaker.Interval,
+		Cooldown:  breaker.Cooldown,
+		OnTrip:    breaker.OnTrip,
+		OnResume:  breaker.OnResume,
+	}
+
+	if b.Interval <= 0 {
+		b.Interval = DefaultStormInterval
+	}
+
+	if b.Cooldown <= 0 {
+		b.Cooldown = DefaultStormCooldown
+	}
+
+	if b.OnTrip == nil {
+		b.OnTrip = func(int, time.Duration) {}
+	}
+
+	if b.OnResume == nil {
+		b.OnResume = func(int) {}
+	}
+
+	return b
+}
+
+// Guard reads the watch results and streams them unless
+// there's an event storm. Errors are always streamed. The
+// stream is closed when the results are exhausted or the
+// context is canceled.
+func (b *StormBreaker) Guard(ctx context.Context, results <-chan WatchResult) <-chan WatchResult {
+	if b.Threshold <= 0 {
+		return results
+	}
+
+	guarded := make(chan WatchResult)
+	go b.startGuarding(ctx, results, guarded)
+	return guarded
+}
+
+// startGuarding streams the results, holding them during a
+// storm, until the results are exhausted or the context is
+// canceled.
+func (b *StormBreaker) startGuarding(ctx context.Context, results <-chan WatchResult, guarded chan<- WatchResult) {
+	defer close(guarded)
+
+	var (
+		held  = []WatchResult{}
+		index = map[string]int{}
+
+		events  = 0
+		tripped = false
+		calmFor time.Duration
+
+		ticker = time.NewTicker(b.Interval)
+	)
+	defer ticker.Stop()
+
+	send := func(wr WatchResult) bool {
+		select {
+		case guarded <- wr:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	trip := func() {
+		tripped = true
+		calmFor = 0
+		b.OnTrip(events, b.Interval)
+	}
+
+	resume := func() bool {
+		tripped = false
+		b.OnResume(len(held))
+
+		pending := held
+		held = []WatchResult{}
+		index = map[string]int{}
+
+		for _, wr := range pending {
+			if !send(wr) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	for {
+		select {
+		case wr, ok := <-results:
+			if !ok {
+				return
+			}
+
+			if wr.Err != nil {
+				if !send(wr) {
+					return
+				}
+				continue
+			}
+
+			events++
+			if !tripped && events > b.Threshold {
+				trip()
+			}
+
+			if !tripped {
+				if !send(wr) {
+					return
+				}
+				continue
+			}
+
+			if i, ok := index[wr.File]; ok {
+				held[i].Op |= wr.Op
+			} else {
+				index[wr.File] = len(held)
+				held = append(held, wr)
+			}
+
+		case <-ticker.C:
+			if tripped {
+				if events > b.Threshold {
+					calmFor = 0
+				} else {
+					calmFor += b.Interval
+				}
+
+				if calmFor >= b.Cooldown && !resume() {
+					return
+				}
+			}
+
+			events = 0
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
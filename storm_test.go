@@ -0,0 +1,113 @@
+package leaf
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStormBreakerTripAndResume(t *testing.T) {
+	var (
+		tripped = make(chan int)
+		resumed = make(chan int)
+	)
+
+	b := NewStormBreaker(StormBreaker{
+		Threshold: 5,
+		Interval:  200 * time.Millisecond,
+		Cooldown:  400 * time.Millisecond,
+		OnTrip:    func(events int, _ time.Duration) { tripped <- events },
+		OnResume:  func(held int) { resumed <- held },
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results := make(chan WatchResult)
+	guarded := b.Guard(ctx, results)
+
+	// A storm of changes to two files.
+	sent := make(chan bool)
+	go func() {
+		for i := 0; i < 20; i++ {
+			if i%2 == 0 {
+				results <- WatchResult{File: "a.go", Op: OpWrite}
+			} else {
+				results <- WatchResult{File: "b.go", Op: OpCreate}
+			}
+		}
+		close(sent)
+	}()
+
+	passed := 0
+	for trip := false; !trip; {
+		select {
+		case <-guarded:
+			passed++
+
+		case events := <-tripped:
+			if events <= b.Threshold {
+				t.Errorf("tripped with %d events, want more than %d", events, b.Threshold)
+			}
+			trip = true
+
+		case <-time.After(time.Second):
+			t.Fatal("storm breaker not tripped")
+		}
+	}
+
+	if passed > b.Threshold {
+		t.Errorf("%d results streamed before the trip, want at most %d", passed, b.Threshold)
+	}
+	<-sent
+
+	// Errors are streamed during the pause.
+	results <- WatchResult{Err: ErrEventOverflow}
+	if res := <-guarded; res.Err != ErrEventOverflow {
+		t.Errorf("got %+v during the pause, want the error", res)
+	}
+
+	var held int
+	select {
+	case res := <-guarded:
+		t.Fatalf("got %+v during the pause, want nothing", res)
+
+	case held = <-resumed:
+
+	case <-time.After(2 * time.Second):
+		t.Fatal("storm breaker not resumed")
+	}
+
+	if held < 1 || held > 2 {
+		t.Fatalf("resumed with %d held results, want 1 or 2 (one per file)", held)
+	}
+
+	// The held results are streamed once per file.
+	seen := map[string]bool{}
+	for i := 0; i < held; i++ {
+		res := <-guarded
+		if seen[res.File] {
+			t.Errorf("result for '%s' streamed again", res.File)
+		}
+		seen[res.File] = true
+
+		if (res.File == "a.go" && res.Op != OpWrite) || (res.File == "b.go" && res.Op != OpCreate) {
+			t.Errorf("got %+v after the resume", res)
+		}
+	}
+
+	// The stream is back to normal.
+	results <- WatchResult{File: "c.go", Op: OpWrite}
+	if res := <-guarded; res.File != "c.go" {
+		t.Errorf("got %+v after the resume, want the change to c.go", res)
+	}
+}
+
+func TestStormBreakerDisabled(t *testing.T) {
+	results := make(chan WatchResult)
+
+	b := NewStormBreaker(StormBreaker{})
+	if guarded := b.Guard(context.Background(), results); guarded != (<-chan WatchResult)(results) {
+		t.Error("results guarded with no threshold")
+	}
+}
@@ -0,0 +1,293 @@
+package leaf
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultSubscriberBuffer is the number of results buffered
+// for each subscriber when none is specified.
+var DefaultSubscriberBuffer = 64
+
+// OverflowPolicy decides what happens to a result when the
+// buffer it's to be delivered to is full.
+type OverflowPolicy int
+
+// The policies for full buffers.
+const (
+	// Block waits until there's space in the buffer. This
+	// stalls the watcher until the subscriber catches up.
+	Block OverflowPolicy = iota
+
+	// DropNewest drops the result being delivered.
+	DropNewest
+
+	// DropOldest drops the oldest result in the buffer to
+	// make space for the result being delivered.
+	DropOldest
+
+	// Coalesce merges the result with the buffered result of
+	// the same file, if any, combining their operations. The
+	// oldest result is dropped if there's none.
+	Coalesce
+)
+
+// overflowPolicies maps the name of each policy to the policy.
+var overflowPolicies = map[string]OverflowPolicy{
+	"block":       Block,
+	"drop-newest": DropNewest,
+	"drop-oldest": DropOldest,
+	"coalesce":    Coalesce,
+}
+
+// ParseOverflowPolicy creates the policy from its name, i.e.,
+// "block", "drop-newest", "drop-oldest" or "coalesce".
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	if name == "" {
+		return Block, nil
+	}
+
+	policy, ok := overflowPolicies[name]
+	if !ok {
+		return Block, fmt.Errorf("invalid overflow policy '%s'", name)
+	}
+
+	return policy, nil
+}
+
+// subscriber is a consumer of the watch results. Results are
+// queued by the watcher and streamed to the consumer from
+// the queue, so the watcher doesn't wait for the consumer
+// unless the policy is to block.
+type subscriber struct {
+	fc   *FilterCollection
+	ch   chan WatchResult
+	done <-chan struct{}
+
+	mu     sync.Mutex
+	queue  []WatchResult
+	size   int
+	closed bool
+
+	// ready is signalled when a result is queued or the queue
+	// is closed and space when a result is taken from it.
+	ready chan struct{}
+	space chan struct{}
+}
+
+// Subscribe streams every result of the watcher that passes
+// the filters (in addition to the filters of the watcher) to
+// the returned channel. All the results are streamed if the
+// filters are nil. Errors and the changes of the state of git
+// repositories are always streamed.
+//
+// Each subscriber has its own buffer and receives the results
+// independent of the other subscribers. When the buffer is
+// full, the overflow policy of the watcher applies. The
+// stream is closed on cancellation of the context or when
+// the watcher is closed.
+func (w *Watcher) Subscribe(ctx context.Context, fc *FilterCollection) <-chan WatchResult {
+	size := w.subBuffer
+	if size <= 0 {
+		size = DefaultSubscriberBuffer
+	}
+
+	sub := &subscriber{
+		fc:    fc,
+		ch:    make(chan WatchResult),
+		done:  ctx.Done(),
+		size:  size,
+		ready: make(chan struct{}, 1),
+		space: make(chan struct{}, 1),
+	}
+
+	w.subsMu.Lock()
+	select {
+	case <-w.done:
+		// The watcher is closed, so there's nothing to stream.
+		w.subsMu.Unlock()
+		close(sub.ch)
+		return sub.ch
+	default:
+	}
+	w.subs[sub] = true
+	w.subsMu.Unlock()
+
+	go func() {
+		sub.stream()
+		w.unsubscribe(sub)
+	}()
+
+	w.start()
+	return sub.ch
+}
+
+// Dropped returns the number of results that were dropped
+// because the buffer of a subscriber was full.
+func (w *Watcher) Dropped() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+// Coalesced returns the number of results that were merged
+// with a buffered result of the same file because the buffer
+// of a subscriber was full.
+func (w *Watcher) Coalesced() uint64 {
+	return atomic.LoadUint64(&w.coalesced)
+}
+
+// unsubscribe stops delivering to the subscriber.
+func (w *Watcher) unsubscribe(sub *subscriber) {
+	w.subsMu.Lock()
+	defer w.subsMu.Unlock()
+
+	delete(w.subs, sub)
+}
+
+// dispatch delivers the results to all the subscribers until
+// the watcher is closed.
+func (w *Watcher) dispatch() {
+	for res := range w.res {
+		if res.Err != nil {
+			w.record(Record{Kind: RecordError, Error: res.Err.Error()})
+		} else {
+			w.record(Record{Kind: RecordResult, File: res.File, Op: res.Op.String()})
+		}
+
+		w.subsMu.Lock()
+		for sub := range w.subs {
+			w.deliver(sub, res)
+		}
+		w.subsMu.Unlock()
+	}
+
+	w.subsMu.Lock()
+	defer w.subsMu.Unlock()
+
+	for sub := range w.subs {
+		sub.close()
+	}
+}
+
+// deliver queues the result for the subscriber if it passes
+// the filters of the subscriber.
+func (w *Watcher) deliver(sub *subscriber, res WatchResult) {
+	if res.Err == nil && res.Op != OpRepo && sub.fc != nil &&
+		!sub.fc.ShouldHandleEvent(NewFileEvent(res.File, res.Op)) {
+		return
+	}
+
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	for w.slowPolicy == Block && len(sub.queue) >= sub.size {
+		sub.mu.Unlock()
+		select {
+		case <-sub.space:
+		case <-sub.done:
+		case <-w.done:
+		}
+		sub.mu.Lock()
+
+		select {
+		case <-sub.done:
+			return
+		case <-w.done:
+			return
+		default:
+		}
+	}
+
+	if len(sub.queue) >= sub.size {
+		switch w.slowPolicy {
+		case DropNewest:
+			atomic.AddUint64(&w.dropped, 1)
+			return
+
+		case Coalesce:
+			if sub.coalesce(res) {
+				atomic.AddUint64(&w.coalesced, 1)
+				return
+			}
+			fallthrough
+
+		case DropOldest:
+			sub.queue = sub.queue[1:]
+			atomic.AddUint64(&w.dropped, 1)
+		}
+	}
+
+	sub.queue = append(sub.queue, res)
+	notify(sub.ready)
+}
+
+// coalesce merges the result with a queued result of the same
+// file. It returns false if there's no such result.
+func (sub *subscriber) coalesce(res WatchResult) bool {
+	if res.Err != nil {
+		return false
+	}
+
+	for i := range sub.queue {
+		if sub.queue[i].Err == nil && sub.queue[i].File == res.File {
+			sub.queue[i].Op |= res.Op
+			return true
+		}
+	}
+
+	return false
+}
+
+// close stops queueing results for the subscriber. The queued
+// results are still streamed.
+func (sub *subscriber) close() {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	sub.closed = true
+	notify(sub.ready)
+}
+
+// stream sends the queued results to the consumer until the
+// queue is closed and empty or the consumer is done.
+func (sub *subscriber) stream() {
+	defer close(sub.ch)
+
+	for {
+		sub.mu.Lock()
+		if len(sub.queue) == 0 {
+			closed := sub.closed
+			sub.mu.Unlock()
+			if closed {
+				return
+			}
+
+			select {
+			case <-sub.ready:
+				continue
+			case <-sub.done:
+				return
+			}
+		}
+
+		res := sub.queue[0]
+		sub.queue = sub.queue[1:]
+		sub.mu.Unlock()
+		notify(sub.space)
+
+		select {
+		case sub.ch <- res:
+		case <-sub.done:
+			return
+		}
+	}
+}
+
+// notify signals the channel without waiting.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
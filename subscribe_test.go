@@ -0,0 +1,338 @@
+package leaf
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestSubscriber creates a subscriber whose queue isn't
+// streamed, i.e., one that never catches up.
+func newTestSubscriber(size int, fc *FilterCollection) *subscriber {
+	return &subscriber{
+		fc:    fc,
+		ch:    make(chan WatchResult),
+		done:  make(chan struct{}),
+		size:  size,
+		ready: make(chan struct{}, 1),
+		space: make(chan struct{}, 1),
+	}
+}
+
+func TestDeliverOverflowPolicies(t *testing.T) {
+	errTest := errors.New("test")
+
+	var (
+		aWrite  = WatchResult{File: "a.go", Op: OpWrite}
+		aCreate = WatchResult{File: "a.go", Op: OpCreate}
+		bWrite  = WatchResult{File: "b.go", Op: OpWrite}
+		cWrite  = WatchResult{File: "c.go", Op: OpWrite}
+		failed  = WatchResult{Err: errTest}
+	)
+
+	tests := []struct {
+		policy    OverflowPolicy
+		results   []WatchResult
+		queue     []WatchResult
+		dropped   uint64
+		coalesced uint64
+	}{
+		{Block, []WatchResult{aWrite, bWrite}, []WatchResult{aWrite, bWrite}, 0, 0},
+		{DropNewest, []WatchResult{aWrite, bWrite}, []WatchResult{aWrite, bWrite}, 0, 0},
+
+		{DropNewest, []WatchResult{aWrite, bWrite, aCreate, cWrite},
+			[]WatchResult{aWrite, bWrite}, 2, 0},
+		{DropOldest, []WatchResult{aWrite, bWrite, aCreate, cWrite},
+			[]WatchResult{aCreate, cWrite}, 2, 0},
+		{Coalesce, []WatchResult{aWrite, bWrite, aCreate},
+			[]WatchResult{{File: "a.go", Op: OpWrite | OpCreate}, bWrite}, 0, 1},
+
+		// The oldest result is dropped if there's nothing to
+		// merge with.
+		{Coalesce, []WatchResult{aWrite, bWrite, aCreate, cWrite},
+			[]WatchResult{bWrite, cWrite}, 1, 1},
+
+		// Errors are never merged.
+		{Coalesce, []WatchResult{failed, aWrite, failed},
+			[]WatchResult{aWrite, failed}, 1, 0},
+	}
+
+	for _, tt := range tests {
+		w := &Watcher{slowPolicy: tt.policy, done: make(chan bool)}
+		sub := newTestSubscriber(2, nil)
+
+		delivered := make(chan bool)
+		go func() {
+			for _, res := range tt.results {
+				w.deliver(sub, res)
+			}
+			close(delivered)
+		}()
+
+		select {
+		case <-delivered:
+		case <-time.After(time.Second):
+			t.Fatalf("policy %d: delivering %v to a full buffer blocked", tt.policy, tt.results)
+		}
+
+		if !reflect.DeepEqual(sub.queue, tt.queue) {
+			t.Errorf("policy %d: queued %v, want %v", tt.policy, sub.queue, tt.queue)
+		}
+
+		if w.Dropped() != tt.dropped {
+			t.Errorf("policy %d: dropped %d, want %d", tt.policy, w.Dropped(), tt.dropped)
+		}
+
+		if w.Coalesced() != tt.coalesced {
+			t.Errorf("policy %d: coalesced %d, want %d", tt.policy, w.Coalesced(), tt.coalesced)
+		}
+	}
+}
+
+func TestDeliverBlocksUntilSpace(t *testing.T) {
+	w := &Watcher{slowPolicy: Block, done: make(chan bool)}
+	sub := newTestSubscriber(1, nil)
+
+	w.deliver(sub, WatchResult{File: "a.go", Op: OpWrite})
+
+	delivered := make(chan bool)
+	go func() {
+		w.deliver(sub, WatchResult{File: "b.go", Op: OpWrite})
+		close(delivered)
+	}()
+
+	select {
+	case <-delivered:
+		t.Fatal("delivered to a full buffer")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	sub.mu.Lock()
+	sub.queue = sub.queue[1:]
+	sub.mu.Unlock()
+	notify(sub.space)
+
+	select {
+	case <-delivered:
+	case <-time.After(time.Second):
+		t.Fatal("not delivered after the buffer had space")
+	}
+
+	if len(sub.queue) != 1 || sub.queue[0].File != "b.go" {
+		t.Errorf("queued %v, want only the change to b.go", sub.queue)
+	}
+}
+
+func TestDeliverFilters(t *testing.T) {
+	fc, err := NewFCFromPatternsRelativeTo([]string{"+ *.go"}, "/r",
+		StandardFilterMatcher, StandardFilterHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &Watcher{slowPolicy: Block, done: make(chan bool)}
+	sub := newTestSubscriber(4, fc)
+
+	results := []WatchResult{
+		{File: "/r/a.txt", Op: OpWrite},
+		{File: "/r/a.go", Op: OpWrite},
+
+		// Errors and changes to the repository aren't filtered.
+		{Err: ErrEventOverflow},
+		{File: "/r", Op: OpRepo},
+	}
+	for _, res := range results {
+		w.deliver(sub, res)
+	}
+
+	if want := results[1:]; !reflect.DeepEqual(sub.queue, want) {
+		t.Errorf("queued %v, want %v", sub.queue, want)
+	}
+}
+
+// newTestWatcher creates a watcher of a temporary directory
+// and returns it with the directory.
+func newTestWatcher(t *testing.T, opts WatcherOptions) (*Watcher, string) {
+	dir, err := ioutil.TempDir("", "leaf-subscribe")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts.Roots = []WatchRoot{{Path: dir}}
+	w, err := NewWatcherWithOptions(opts)
+	if err != nil {
+		os.RemoveAll(dir) // nolint:errcheck
+		t.Fatal(err)
+	}
+
+	return w, dir
+}
+
+// receive waits for a result for the file, skipping the other
+// results.
+func receive(t *testing.T, results <-chan WatchResult, file string) {
+	for timeout := time.After(2 * time.Second); ; {
+		select {
+		case res, ok := <-results:
+			if !ok {
+				t.Fatalf("stream closed before the change to '%s'", file)
+			}
+
+			if res.Err != nil {
+				t.Fatal(res.Err)
+			}
+
+			if res.File == file {
+				return
+			}
+
+		case <-timeout:
+			t.Fatalf("no result for '%s'", file)
+		}
+	}
+}
+
+// receiveRewriting writes the file until there's a result for
+// it, since the results can be dropped for any subscriber
+// with a small buffer.
+func receiveRewriting(t *testing.T, results <-chan WatchResult, file string) bool {
+	for timeout := time.After(2 * time.Second); ; {
+		if err := ioutil.WriteFile(file, []byte("package a\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		for retry := time.After(100 * time.Millisecond); ; {
+			select {
+			case res, ok := <-results:
+				if !ok {
+					return false
+				}
+
+				if res.Err == nil && res.File == file {
+					return true
+				}
+				continue
+
+			case <-retry:
+			case <-timeout:
+				return false
+			}
+
+			break
+		}
+	}
+}
+
+// closed waits for the stream to be closed, skipping the
+// remaining results.
+func closed(results <-chan WatchResult) bool {
+	for timeout := time.After(time.Second); ; {
+		select {
+		case _, ok := <-results:
+			if !ok {
+				return true
+			}
+
+		case <-timeout:
+			return false
+		}
+	}
+}
+
+func TestSubscribeFanOut(t *testing.T) {
+	w, dir := newTestWatcher(t, WatcherOptions{})
+	defer os.RemoveAll(dir) // nolint:errcheck
+	defer w.Close()         // nolint:errcheck
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first := w.Subscribe(ctx, nil)
+	second := w.Subscribe(ctx, nil)
+
+	for _, name := range []string{"a.go", "b.go", "c.go"} {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte("package a\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		receive(t, first, file)
+		receive(t, second, file)
+	}
+}
+
+func TestSlowSubscriberDoesNotBlock(t *testing.T) {
+	for _, policy := range []OverflowPolicy{DropNewest, DropOldest, Coalesce} {
+		w, dir := newTestWatcher(t, WatcherOptions{
+			SubscriberBuffer:     1,
+			SlowSubscriberPolicy: policy,
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		// The slow subscriber is never read from.
+		w.Subscribe(ctx, nil)
+		fast := w.Subscribe(ctx, nil)
+
+		for _, name := range []string{"a.go", "b.go", "c.go", "d.go"} {
+			file := filepath.Join(dir, name)
+			if !receiveRewriting(t, fast, file) {
+				t.Fatalf("policy %d: no result for '%s'", policy, file)
+			}
+		}
+
+		if w.Dropped() == 0 {
+			t.Errorf("policy %d: no results dropped for the slow subscriber", policy)
+		}
+
+		cancel()
+		w.Close()         // nolint:errcheck
+		os.RemoveAll(dir) // nolint:errcheck
+	}
+}
+
+func TestSubscribeClosed(t *testing.T) {
+	w, dir := newTestWatcher(t, WatcherOptions{})
+	defer os.RemoveAll(dir) // nolint:errcheck
+	defer w.Close()         // nolint:errcheck
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	canceled := w.Subscribe(ctx, nil)
+	open := w.Subscribe(context.Background(), nil)
+
+	cancel()
+	if !closed(canceled) {
+		t.Error("stream not closed on cancellation of the context")
+	}
+
+	// The other subscribers aren't affected.
+	file := filepath.Join(dir, "a.go")
+	if err := ioutil.WriteFile(file, []byte("package a\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, open, file)
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !closed(open) {
+		t.Error("stream not closed on closing the watcher")
+	}
+
+	// Subscribing to a closed watcher streams nothing.
+	if !closed(w.Subscribe(context.Background(), nil)) {
+		t.Error("stream of a closed watcher not closed")
+	}
+}
@@ -3,138 +3,1145 @@ package leaf
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
+)
+
+// Op describes a set of file operations.
+type Op uint32
 
-	"github.com/fsnotify/fsnotify"
+// The operations on a file that the watcher reports.
+const (
+	OpCreate Op = 1 << iota
+	OpWrite
+	OpRemove
+	OpRename
+	OpChmod
+
+	// OpRepo is the change of the state of a git repository,
+	// like a checkout or a commit.
+	OpRepo
 )
 
-// WatchResult has the file changed or the error that occurred
-// during watching.
+// AllOps has all the operations set.
+const AllOps = OpCreate | OpWrite | OpRemove | OpRename | OpChmod | OpRepo
+
+// opNames maps the name of each operation to the operation.
+var opNames = []struct {
+	name string
+	op   Op
+}{
+	{"create", OpCreate},
+	{"write", OpWrite},
+	{"remove", OpRemove},
+	{"rename", OpRename},
+	{"chmod", OpChmod},
+	{"repo", OpRepo},
+}
+
+// String returns the operations in a human-readable format,
+// like `create|write`.
+func (op Op) String() string {
+	names := []string{}
+	for _, o := range opNames {
+		if op&o.op == o.op {
+			names = append(names, o.name)
+		}
+	}
+
+	return strings.Join(names, "|")
+}
+
+// Has tells if any of the operations in other is set in op.
+func (op Op) Has(other Op) bool {
+	return op&other != 0
+}
+
+// ParseOps creates a set of operations from their names,
+// i.e., "create", "write", "remove", "rename", "chmod" or
+// "repo".
+func ParseOps(names []string) (Op, error) {
+	var op Op
+
+	for _, name := range names {
+		found := false
+		cleanedName := strings.ToLower(strings.Trim(name, " "))
+
+		for _, o := range opNames {
+			if o.name == cleanedName {
+				op |= o.op
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return 0, fmt.Errorf(
+				"invalid operation '%s'", name)
+		}
+	}
+
+	return op, nil
+}
+
+// WatchResult has the file changed along-with the operation
+// on it or the error that occurred during watching.
 type WatchResult struct {
 	File string
+	Op   Op
 	Err  error
 }
 
-// Watcher watches a directory for changes and updates the
+// Watcher watches directories for changes and updates the
 // stream when a file change (valid by filters) is updated.
+// Events from all the root directories are reported on the
+// same stream.
+//
+// Directories created inside the roots after the watcher
+// starts are added to the watch (unless excluded) and
+// directories that are removed are dropped from it.
+//
+// Individual files can also be watched. These are watched
+// through their parent directory but only the changes to the
+// files themselves are reported.
 type Watcher struct {
-	root    string
-	paths   []string
+	// dropped and coalesced count the results not delivered
+	// as is to the subscribers. These are accessed atomically
+	// and come first to be 64-bit aligned.
+	dropped   uint64
+	coalesced uint64
+
+	rootsMu sync.RWMutex
+	roots   []*watchRoot
 	exclude []string
+	fc      *FilterCollection
+
+	mu        sync.Mutex
+	paths     map[string]bool
+	polled    map[string]bool
+	realPaths map[string]string
+	files     map[string]bool
+	fileDirs  map[string]bool
 
-	fc       *FilterCollection
-	notifier *fsnotify.Watcher
+	followSymlinks bool
+
+	notifier Backend
+	fallback Backend
+	ignores  *ignoreList
+	hashes   *hashCache
+	git      *gitWatch
+	recorder *Recorder
+
+	startOnce sync.Once
+	closeOnce sync.Once
+	done      chan bool
+
+	subsMu     sync.Mutex
+	subs       map[*subscriber]bool
+	subBuffer  int
+	slowPolicy OverflowPolicy
+
+	// state is the last known state of the files, recorded
+	// when rescanOnOverflow is set, used to find the changes
+	// lost when the events overflow.
+	rescanOnOverflow bool
+	state            *Snapshot
 
 	res chan WatchResult
 }
 
+// watchRoot is a root directory being watched along-with the
+// resolved excludes and filters that apply inside it.
+type watchRoot struct {
+	path    string
+	exclude [][]string
+	fc      *FilterCollection
+}
+
+// WatchRoot is a directory to watch with the excludes and
+// filters specific to it.
+type WatchRoot struct {
+	// Path of the directory to watch.
+	Path string
+
+	// Exclude these directories from watch in addition to the
+	// common excludes.
+	Exclude []string
+
+	// Filters to apply on the changed files inside the root.
+	// The common filters are used if nil.
+	Filters *FilterCollection
+}
+
+// WatcherOptions are the options to create a watcher with.
+type WatcherOptions struct {
+	// Roots are the directories to watch.
+	Roots []WatchRoot
+
+	// FollowSymlinks watches the directories that symbolic
+	// links inside the roots point to. A directory reachable
+	// through multiple links is watched only once.
+	FollowSymlinks bool
+
+	// Files to watch in addition to the roots. These can be
+	// outside the roots and changes to these are reported
+	// regardless of the excludes, ignores and filters.
+	Files []string
+
+	// Exclude these directories from watch in all the roots.
+	// Relative paths are resolved against each root. These can
+	// be glob patterns, where "**" matches any number of
+	// directories, e.g., "**/testdata" or "*/dist". A pattern
+	// excludes the matching directories and everything inside
+	// them, including the directories created later.
+	Exclude []string
+
+	// Filters to apply on the changed files.
+	Filters *FilterCollection
+
+	// IgnoreFiles are the names of the files, written in the
+	// gitignore syntax, that list the paths to ignore, e.g.,
+	// ".gitignore" and ".leafignore". These are read from
+	// every watched directory and apply to the paths inside.
+	IgnoreFiles []string
+
+	// HashContents reports writes to a file only when its
+	// content differs from the last observed content. This
+	// suppresses writes with identical bytes, e.g., by
+	// formatters.
+	HashContents bool
+
+	// HashCacheSize is the number of files for which the
+	// content hash is remembered. DefaultHashCacheSize is used
+	// if not set.
+	HashCacheSize int
+
+	// HashMaxSize is the size in bytes above which the files
+	// are not hashed and their writes are always reported.
+	// DefaultHashMaxSize is used if not set.
+	HashMaxSize int64
+
+	// PollOnWatchLimit polls the directories that can't be
+	// watched because the limit of watches set by the kernel
+	// is reached, instead of failing with a WatchLimitError.
+	PollOnWatchLimit bool
+
+	// PollInterval is the interval after which the directories
+	// that exceed the watch limit are polled.
+	PollInterval time.Duration
+
+	// RescanOnOverflow scans the directories again when the
+	// events overflow (ErrEventOverflow) and reports the files
+	// changed since the last known state, so that no change
+	// is lost. The state of all the files is recorded when
+	// the watch starts.
+	RescanOnOverflow bool
+
+	// SubscriberBuffer is the number of results buffered for
+	// each subscriber. DefaultSubscriberBuffer is used if not
+	// set.
+	SubscriberBuffer int
+
+	// SlowSubscriberPolicy decides what happens to a result
+	// when the buffer of a subscriber is full. By default the
+	// delivery blocks until the subscriber catches up, which
+	// stalls the watcher. The other policies never block and
+	// are counted by Dropped and Coalesced.
+	SlowSubscriberPolicy OverflowPolicy
+
+	// Git watches the state (HEAD and refs) of the git
+	// repositories that the roots are in. The changes made by
+	// git operations, like a checkout, are reported as a
+	// single result with the OpRepo operation on the git
+	// directory once the repository is quiet for GitSettle
+	// (DefaultGitSettle if not set). The other changes inside
+	// the repositories are delayed by GitSettle.
+	Git       bool
+	GitSettle time.Duration
+
+	// Recorder records the raw events, whether they pass the
+	// filters or not, and the results, so that the session
+	// can be replayed.
+	Recorder *Recorder
+
+	// Backend reports the file system events. The fsnotify
+	// backend is used if none is provided. The watcher closes
+	// the backend when done watching.
+	Backend Backend
+}
+
 // NewWatcher returns a watcher from the given options.
 func NewWatcher(root string, exclude []string, fc *FilterCollection) (*Watcher, error) {
+	return NewWatcherWithOptions(WatcherOptions{
+		Roots:   []WatchRoot{{Path: root}},
+		Exclude: exclude,
+		Filters: fc,
+	})
+}
+
+// NewWatcherWithOptions returns a watcher from the given
+// options.
+func NewWatcherWithOptions(opts WatcherOptions) (*Watcher, error) {
 	w := &Watcher{
-		fc:  fc,
-		res: make(chan WatchResult),
+		paths:     map[string]bool{},
+		polled:    map[string]bool{},
+		realPaths: map[string]string{},
+		files:     map[string]bool{},
+		fileDirs:  map[string]bool{},
+		ignores:   newIgnoreList(opts.IgnoreFiles),
+		exclude:   opts.Exclude,
+		fc:        opts.Filters,
+		done:      make(chan bool),
+		res:       make(chan WatchResult),
+
+		subs:       map[*subscriber]bool{},
+		subBuffer:  opts.SubscriberBuffer,
+		slowPolicy: opts.SlowSubscriberPolicy,
+
+		followSymlinks:   opts.FollowSymlinks,
+		rescanOnOverflow: opts.RescanOnOverflow,
+		recorder:         opts.Recorder,
+	}
+
+	if opts.HashContents {
+		w.hashes = newHashCache(opts.HashCacheSize, opts.HashMaxSize)
+	}
+
+	if len(opts.Roots) == 0 && len(opts.Files) == 0 {
+		return nil, fmt.Errorf("no root directory or file to watch")
+	}
+
+	for _, r := range opts.Roots {
+		root, err := newWatchRoot(r, w.exclude, w.fc)
+		if err != nil {
+			return nil, err
+		}
+
+		w.roots = append(w.roots, root)
+	}
+
+	w.notifier = opts.Backend
+	if w.notifier == nil {
+		var err error
+		w.notifier, err = NewFsnotifyBackend()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.PollOnWatchLimit {
+		w.fallback = NewPollBackend(opts.PollInterval)
+	}
+
+	for _, root := range w.roots {
+		if err := w.addDirs(root.path); err != nil {
+			w.closeBackends() // nolint:errcheck
+			return nil, err
+		}
 	}
 
-	isdir, err := isDir(root)
+	for _, file := range opts.Files {
+		if err := w.addFile(file); err != nil {
+			w.closeBackends() // nolint:errcheck
+			return nil, err
+		}
+	}
+
+	if opts.Git {
+		w.git = newGitWatch(opts.GitSettle)
+		for _, root := range w.roots {
+			if err := w.addGitRepo(root.path); err != nil {
+				w.closeBackends() // nolint:errcheck
+				return nil, err
+			}
+		}
+	}
+
+	return w, nil
+}
+
+// newWatchRoot validates the root and resolves its excludes.
+func newWatchRoot(r WatchRoot, exclude []string, fc *FilterCollection) (*watchRoot, error) {
+	isdir, err := isDir(r.Path)
 	if err != nil {
 		return nil, err
 	}
 
 	if !isdir {
 		return nil, fmt.Errorf(
-			"path '%s' is not a directory", root)
+			"path '%s' is not a directory", r.Path)
+	}
+
+	root := &watchRoot{
+		exclude: [][]string{},
+		fc:      r.Filters,
 	}
 
-	w.root = filepath.Clean(root)
-	w.paths, err = getAllDirs(w.root)
+	root.path, err = filepath.Abs(r.Path)
 	if err != nil {
 		return nil, err
 	}
 
-	w.exclude = []string{}
-	for _, path := range exclude {
-		var absPath string
+	if root.fc == nil {
+		root.fc = fc
+	}
 
-		if _, err = isDir(path); err != nil {
-			continue
+	for _, path := range append(append([]string{}, exclude...), r.Exclude...) {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(escapeGlob(root.path), path)
 		}
 
-		absPath, err = filepath.Abs(path)
-		if err != nil {
-			continue
+		root.exclude = append(root.exclude, splitPath(filepath.Clean(path)))
+	}
+
+	return root, nil
+}
+
+// Watch executes the watching of files and streams all the
+// results. The watcher is closed on cancellation of the
+// context. Use Subscribe to stream the results to multiple
+// consumers without closing the watcher.
+func (w *Watcher) Watch(ctx context.Context) <-chan WatchResult {
+	results := w.Subscribe(ctx, nil)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			w.Close() // nolint:errcheck
+		case <-w.done:
 		}
+	}()
 
-		w.exclude = append(w.exclude, absPath)
+	return results
+}
+
+// start starts watching, if not started already.
+func (w *Watcher) start() {
+	w.startOnce.Do(func() {
+		go w.startWatcher()
+		go w.dispatch()
+	})
+}
+
+// Add starts watching the path. A directory is watched
+// recursively as a root with the common excludes and filters,
+// while a file is watched individually. It's safe to call
+// while watching.
+func (w *Watcher) Add(path string) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	isdir, err := isDir(absPath)
+	if err != nil || !isdir {
+		return w.addFile(absPath)
 	}
 
-	w.notifier, err = fsnotify.NewWatcher()
+	root, err := newWatchRoot(WatchRoot{Path: absPath}, w.exclude, w.fc)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	for _, f := range w.paths {
-		exclude := false
-		for _, e := range w.exclude {
-			if strings.HasPrefix(f, e) {
-				exclude = true
-				break
-			}
+	w.rootsMu.Lock()
+	for _, r := range w.roots {
+		if r.path == root.path {
+			w.rootsMu.Unlock()
+			return nil
 		}
+	}
+	w.roots = append(w.roots, root)
+	w.rootsMu.Unlock()
+
+	if err := w.addDirs(root.path); err != nil {
+		return err
+	}
 
-		if exclude {
+	if w.git != nil {
+		return w.addGitRepo(root.path)
+	}
+
+	return nil
+}
+
+// Remove stops watching the path, which is either a root
+// directory or an individually watched file. It's safe to
+// call while watching.
+func (w *Watcher) Remove(path string) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	if w.removeFile(absPath) {
+		return nil
+	}
+
+	w.rootsMu.Lock()
+	found := false
+	roots := []*watchRoot{}
+	for _, r := range w.roots {
+		if r.path == absPath {
+			found = true
 			continue
 		}
 
-		if err := w.notifier.Add(f); err != nil {
-			return nil, err
+		roots = append(roots, r)
+	}
+	w.roots = roots
+	w.rootsMu.Unlock()
+
+	if !found {
+		return fmt.Errorf("path '%s' is not being watched", path)
+	}
+
+	w.removeDirs(absPath)
+	if w.git != nil {
+		w.removeGitRepo(absPath)
+	}
+
+	// The directories are still watched if the removed root
+	// is inside another one.
+	if w.rootOf(absPath) != nil {
+		return w.addDirs(absPath)
+	}
+
+	// Roots nested in the removed one are still watched.
+	for _, r := range roots {
+		if hasPathPrefix(r.path, absPath) {
+			if err := w.addDirs(r.path); err != nil {
+				return err
+			}
 		}
 	}
 
-	return w, nil
+	return nil
 }
 
-// Watch executes the watching of files. Exits on cancellation
-// of the context.
-func (w *Watcher) Watch(ctx context.Context) <-chan WatchResult {
-	go w.startWatcher(ctx)
-	return w.res
+// WatchedPaths returns the root directories and the files
+// being watched individually.
+func (w *Watcher) WatchedPaths() []string {
+	paths := w.rootPaths()
+
+	w.mu.Lock()
+	for file := range w.files {
+		paths = append(paths, file)
+	}
+	w.mu.Unlock()
+
+	sort.Strings(paths)
+	return paths
+}
+
+// Close stops watching all the paths. The stream returned by
+// Watch is closed.
+func (w *Watcher) Close() error {
+	var err error
+
+	w.closeOnce.Do(func() {
+		close(w.done)
+		err = w.closeBackends()
+	})
+
+	return err
 }
 
 // startWatcher starts the fs.Notifier and watches for changes
 // in files in the root directory.
-func (w *Watcher) startWatcher(ctx context.Context) {
-	defer w.notifier.Close() // nolint:errcheck
+func (w *Watcher) startWatcher() {
+	defer w.Close() // nolint:errcheck
+
+	if w.rescanOnOverflow {
+		w.recordState()
+	}
+
+	// Receiving from nil channels blocks forever, so there
+	// are no events from the fallback if there's none.
+	var (
+		events         = w.notifier.Events()
+		errors         = w.notifier.Errors()
+		fallbackEvents <-chan Event
+		fallbackErrors <-chan error
+		gitSettled     <-chan time.Time
+	)
+
+	if w.fallback != nil {
+		fallbackEvents = w.fallback.Events()
+		fallbackErrors = w.fallback.Errors()
+	}
+
+	if w.git != nil {
+		gitSettled = w.git.timer.C
+	}
+
 	for {
 		select {
-		case event := <-w.notifier.Events:
-			if event.Op == fsnotify.Write {
-				file := event.Name
-				if w.fc.ShouldHandlePath(file) {
-					w.res <- WatchResult{File: file}
-				}
+		case event := <-events:
+			w.handleEvent(event)
+
+		case event := <-fallbackEvents:
+			w.handleEvent(event)
+
+		case err, ok := <-errors:
+			if !ok {
+				errors = nil
+				continue
 			}
+			w.handleError(err)
 
-		case err := <-w.notifier.Errors:
-			if err != nil {
-				w.res <- WatchResult{Err: err}
+		case err, ok := <-fallbackErrors:
+			if !ok {
+				fallbackErrors = nil
+				continue
 			}
+			w.handleError(err)
 
-		case <-ctx.Done():
+		case <-gitSettled:
+			w.settleGit()
+
+		case <-w.done:
 			close(w.res)
 			return
 		}
 	}
 }
 
+// handleEvent updates the watch for the event and streams the
+// result if the change is to be reported.
+func (w *Watcher) handleEvent(event Event) {
+	if w.isRecording(event.Name) {
+		return
+	}
+
+	w.record(Record{Kind: RecordEvent, File: event.Name, Op: event.Op.String()})
+
+	if w.git != nil && w.handleGitEvent(event) {
+		return
+	}
+
+	// Directories watched only for the files in them are not
+	// watched recursively.
+	_, onlyFiles := w.isWatchedFile(event.Name)
+	if !onlyFiles {
+		if err := w.updateDirs(event); err != nil {
+			w.res <- WatchResult{Err: err}
+		}
+	}
+
+	if w.state != nil {
+		w.updateState(event.Name)
+	}
+
+	report := w.shouldReport(event.Name, event.Op) && w.contentChanged(event)
+	w.record(Record{Kind: RecordFilter, File: event.Name, Op: event.Op.String(), Handled: report})
+
+	if report {
+		w.send(WatchResult{File: event.Name, Op: event.Op})
+	}
+
+	if !onlyFiles && event.Op.Has(OpCreate) && w.isWatchedDir(event.Name) {
+		w.reportContents(event.Name)
+	}
+}
+
+// reportContents reports the creation of the files inside the
+// newly watched directory. These might have been created
+// before the directory was watched, e.g., by `cp -r` or
+// `git checkout`, in which case there are no events for them.
+func (w *Watcher) reportContents(dir string) {
+	walkFn := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// The path might have been removed already.
+			return nil
+		}
+
+		if path == dir {
+			return nil
+		}
+
+		if info.IsDir() && !w.isWatchedDir(path) {
+			// Excluded or ignored directories are not watched.
+			return filepath.SkipDir
+		}
+
+		w.reportChange(path, OpCreate)
+		return nil
+	}
+
+	filepath.Walk(dir, walkFn) // nolint:errcheck
+}
+
+// reportChange streams the change found without an event on
+// it, e.g., by scanning the directories, if it's to be
+// reported.
+func (w *Watcher) reportChange(path string, op Op) {
+	if w.isRecording(path) {
+		return
+	}
+
+	w.record(Record{Kind: RecordEvent, File: path, Op: op.String()})
+
+	if w.state != nil {
+		w.updateState(path)
+	}
+
+	event := Event{Name: path, Op: op}
+	report := w.shouldReport(path, op) && w.contentChanged(event)
+	w.record(Record{Kind: RecordFilter, File: path, Op: op.String(), Handled: report})
+
+	if report {
+		w.send(WatchResult{File: path, Op: op})
+	}
+}
+
+// send streams the change unless it's held until a git
+// operation is done.
+func (w *Watcher) send(res WatchResult) {
+	if w.git != nil && w.holdGitChange(res) {
+		return
+	}
+
+	w.res <- res
+}
+
+// handleError streams the error that occurred while watching.
+// When the events overflow, the directories are scanned again
+// instead.
+func (w *Watcher) handleError(err error) {
+	if err == nil {
+		return
+	}
+
+	if err == ErrEventOverflow && w.state != nil {
+		w.rescan()
+		return
+	}
+
+	w.res <- WatchResult{Err: err}
+}
+
+// shouldReport tells if the change to the path is to be
+// reported, i.e., it's either an individually watched file or
+// it isn't excluded or ignored and passes the filters. The
+// recording of the session is never reported.
+func (w *Watcher) shouldReport(path string, op Op) bool {
+	isFile, onlyFiles := w.isWatchedFile(path)
+
+	switch {
+	case w.isRecording(path):
+		return false
+
+	case isFile:
+		return true
+
+	case onlyFiles:
+		return false
+	}
+
+	return !w.isExcluded(path) && !w.isIgnored(path) && w.shouldHandlePath(path, op)
+}
+
+// isWatchedFile tells if the path is one of the individually
+// watched files and if its directory is watched only for
+// such files.
+func (w *Watcher) isWatchedFile(path string) (isFile, onlyFiles bool) {
+	dir := filepath.Dir(path)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.files[path], w.fileDirs[dir] && !w.paths[dir]
+}
+
+// isWatchedDir tells if the directory is watched recursively.
+func (w *Watcher) isWatchedDir(path string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.paths[path]
+}
+
+// contentChanged tells if the event changes the content of
+// the file when content hashing is enabled.
+func (w *Watcher) contentChanged(event Event) bool {
+	if w.hashes == nil {
+		return true
+	}
+
+	switch {
+	case event.Op.Has(OpRemove | OpRename):
+		w.hashes.forget(event.Name)
+
+	case event.Op.Has(OpCreate | OpWrite):
+		return w.hashes.changed(event.Name)
+	}
+
+	return true
+}
+
+// updateDirs keeps the watched directories in sync with the
+// file system. A created directory is added (recursively) to
+// the watch and a removed or renamed one is dropped from it.
+func (w *Watcher) updateDirs(event Event) error {
+	if w.ignores.isIgnoreFile(event.Name) {
+		// Reload the rules and watch the directories that
+		// might not be ignored anymore.
+		dir := filepath.Dir(event.Name)
+		w.ignores.load(dir)
+
+		if isdir, err := isDir(dir); err == nil && isdir {
+			if err := w.addDirs(dir); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch {
+	case event.Op.Has(OpCreate):
+		isdir, err := isDir(event.Name)
+		if err != nil || !isdir {
+			// The path might have been removed already, in
+			// which case there's nothing to watch.
+			return nil
+		}
+
+		return w.addDirs(event.Name)
+
+	case event.Op.Has(OpRemove | OpRename):
+		w.removeDirs(event.Name)
+	}
+
+	return nil
+}
+
+// addDirs adds all the directories (including the root) inside
+// the given root directory to the notifier, skipping the ones
+// that are excluded.
+func (w *Watcher) addDirs(root string) error {
+	skip := func(dir string) bool {
+		if w.isExcluded(dir) {
+			return true
+		}
+
+		// Rules of the directory should be loaded before
+		// walking the directories inside it.
+		w.ignores.load(dir)
+		return false
+	}
+
+	dirs, err := getAllDirs(root, skip, w.followSymlinks)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, dir := range dirs {
+		if w.paths[dir] {
+			continue
+		}
+
+		realPath := dir
+		if w.followSymlinks {
+			// The same directory might be reachable through
+			// a different link, in which case it's already
+			// being watched.
+			realPath, err = filepath.EvalSymlinks(dir)
+			if err != nil {
+				continue
+			}
+
+			if _, ok := w.realPaths[realPath]; ok {
+				continue
+			}
+		}
+
+		if err := w.notifier.Add(dir); err != nil {
+			if os.IsNotExist(err) {
+				// Removed since it was walked.
+				continue
+			}
+
+			if !isWatchLimitErr(err) {
+				return err
+			}
+
+			if w.fallback == nil {
+				return newWatchLimitError(err, w.allDirs(dirs), len(w.paths), w.rootPaths())
+			}
+
+			if err := w.fallback.Add(dir); err != nil {
+				return err
+			}
+
+			w.polled[dir] = true
+		}
+
+		w.paths[dir] = true
+		w.realPaths[realPath] = dir
+	}
+
+	return nil
+}
+
+// allDirs returns the directories being watched along-with
+// the given directories.
+func (w *Watcher) allDirs(dirs []string) []string {
+	all := []string{}
+	for _, dir := range dirs {
+		if !w.paths[dir] {
+			all = append(all, dir)
+		}
+	}
+
+	for dir := range w.paths {
+		all = append(all, dir)
+	}
+
+	return all
+}
+
+// rootPaths returns the paths of the root directories.
+func (w *Watcher) rootPaths() []string {
+	w.rootsMu.RLock()
+	defer w.rootsMu.RUnlock()
+
+	paths := []string{}
+	for _, root := range w.roots {
+		paths = append(paths, root.path)
+	}
+
+	return paths
+}
+
+// PolledDirs returns the directories that are polled because
+// they exceeded the watch limit.
+func (w *Watcher) PolledDirs() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	dirs := []string{}
+	for dir := range w.polled {
+		dirs = append(dirs, dir)
+	}
+
+	sort.Strings(dirs)
+	return dirs
+}
+
+// closeBackends closes the backends of the watcher.
+func (w *Watcher) closeBackends() error {
+	err := w.notifier.Close()
+	if w.fallback != nil {
+		if ferr := w.fallback.Close(); err == nil {
+			err = ferr
+		}
+	}
+
+	return err
+}
+
+// removeFile stops watching the individually watched file.
+// Returns false if the file is not being watched.
+func (w *Watcher) removeFile(path string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.files[path] {
+		return false
+	}
+
+	delete(w.files, path)
+
+	dir := filepath.Dir(path)
+	for file := range w.files {
+		if filepath.Dir(file) == dir {
+			return true
+		}
+	}
+
+	// No other file in the directory is watched.
+	delete(w.fileDirs, dir)
+	if !w.paths[dir] {
+		w.notifier.Remove(dir) // nolint:errcheck
+	}
+
+	return true
+}
+
+// addFile watches the individual file through its parent
+// directory.
+func (w *Watcher) addFile(file string) error {
+	path, err := expandHome(file)
+	if err != nil {
+		return err
+	}
+
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	isdir, err := isDir(dir)
+	if err != nil {
+		return fmt.Errorf(
+			"directory of file '%s' invalid: %v", file, err)
+	}
+
+	if !isdir {
+		return fmt.Errorf(
+			"path '%s' is not a directory", dir)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.paths[dir] && !w.fileDirs[dir] {
+		if err := w.notifier.Add(dir); err != nil {
+			return err
+		}
+	}
+
+	w.files[path] = true
+	w.fileDirs[dir] = true
+	return nil
+}
+
+// removeDirs removes the directory and all the directories
+// inside it from the notifier.
+func (w *Watcher) removeDirs(root string) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for dir := range w.paths {
+		if dir != absRoot && !hasPathPrefix(dir, absRoot) {
+			continue
+		}
+
+		// The watch is removed automatically by the kernel
+		// when the directory is deleted, so the error here
+		// is of no consequence.
+		if w.polled[dir] {
+			w.fallback.Remove(dir) // nolint:errcheck
+			delete(w.polled, dir)
+		} else if !w.fileDirs[dir] {
+			// Directories of the individually watched files
+			// are still watched for them.
+			w.notifier.Remove(dir) // nolint:errcheck
+		}
+		delete(w.paths, dir)
+
+		for realPath, path := range w.realPaths {
+			if path == dir {
+				delete(w.realPaths, realPath)
+			}
+		}
+	}
+}
+
+// rootOf returns the root directory that contains the path.
+// In case of nested roots the innermost one is returned.
+func (w *Watcher) rootOf(path string) *watchRoot {
+	w.rootsMu.RLock()
+	defer w.rootsMu.RUnlock()
+
+	var found *watchRoot
+
+	for _, root := range w.roots {
+		if path != root.path && !hasPathPrefix(path, root.path) {
+			continue
+		}
+
+		if found == nil || len(root.path) > len(found.path) {
+			found = root
+		}
+	}
+
+	return found
+}
+
+// isExcluded tells if the path is excluded from watching.
+func (w *Watcher) isExcluded(path string) bool {
+	root := w.rootOf(path)
+	if root == nil {
+		return false
+	}
+
+	segments := splitPath(path)
+	for _, e := range root.exclude {
+		if matchSegmentsPrefix(e, segments) {
+			return true
+		}
+	}
+
+	// Rules above the root directory don't apply to it.
+	return path != root.path && w.ignores.isIgnored(path, true)
+}
+
+// isIgnored tells if the changed path is ignored by the rules
+// in the ignore files.
+func (w *Watcher) isIgnored(path string) bool {
+	isdir, err := isDir(path)
+	if err != nil {
+		isdir = false
+	}
+
+	return w.ignores.isIgnored(path, isdir)
+}
+
+// shouldHandlePath tells if the changed path passes the
+// filters of its root.
+func (w *Watcher) shouldHandlePath(path string, op Op) bool {
+	root := w.rootOf(path)
+	if root == nil || root.fc == nil {
+		return true
+	}
+
+	return root.fc.ShouldHandleEvent(NewFileEvent(path, op))
+}
+
 // getAllDirs gets all the directories (including the root)
-// inside the given root directory.
-func getAllDirs(root string) ([]string, error) {
+// inside the given root directory. Directories for which skip
+// returns true are not traversed. Symbolic links to
+// directories are traversed only if follow is true.
+func getAllDirs(root string, skip func(string) bool, follow bool) ([]string, error) {
+	if follow {
+		absRoot, err := filepath.Abs(root)
+		if err != nil {
+			return nil, err
+		}
+
+		paths := []string{}
+		err = walkDirsFollowingSymlinks(absRoot, skip, map[string]bool{}, &paths)
+		if err != nil {
+			return nil, err
+		}
+
+		return paths, nil
+	}
+
 	paths := []string{}
 
 	walkFn := func(path string, info os.FileInfo, err error) error {
 		if err != nil {
+			// Directories created and removed quickly, like the
+			// temporary ones of builds, might be gone already.
+			if os.IsNotExist(err) {
+				return nil
+			}
+
 			return err
 		}
 
@@ -144,6 +1151,10 @@ func getAllDirs(root string) ([]string, error) {
 				return err
 			}
 
+			if skip != nil && skip(absPath) {
+				return filepath.SkipDir
+			}
+
 			paths = append(paths, absPath)
 		}
 
@@ -157,3 +1168,66 @@ func getAllDirs(root string) ([]string, error) {
 
 	return paths, nil
 }
+
+// walkDirsFollowingSymlinks appends the directory and all the
+// directories inside it to paths, traversing the symbolic
+// links to directories. Visited has the real paths of the
+// directories traversed already, so that the directories are
+// not traversed twice and cycles of links are broken.
+func walkDirsFollowingSymlinks(dir string, skip func(string) bool, visited map[string]bool, paths *[]string) error {
+	realPath, err := filepath.EvalSymlinks(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if visited[realPath] {
+		return nil
+	}
+	visited[realPath] = true
+
+	if skip != nil && skip(dir) {
+		return nil
+	}
+
+	*paths = append(*paths, dir)
+
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			// Links that are broken or don't point to a
+			// directory are not traversed.
+			info, err = os.Stat(path)
+			if err != nil {
+				continue
+			}
+		}
+
+		if !info.IsDir() {
+			continue
+		}
+
+		if err := walkDirsFollowingSymlinks(path, skip, visited, paths); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hasPathPrefix tells if the path is inside the directory
+// prefix.
+func hasPathPrefix(path, prefix string) bool {
+	return strings.HasPrefix(path, prefix+string(filepath.Separator))
+}
@@ -0,0 +1,156 @@
+package leaf
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeFile writes a Go file to the path.
+func writeFile(t *testing.T, path string) {
+	if err := ioutil.WriteFile(path, []byte("package a\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receiveWithout waits for a result for the file and fails if
+// there's a result for the unwanted file before it.
+func receiveWithout(t *testing.T, results <-chan WatchResult, file, unwanted string) {
+	for timeout := time.After(2 * time.Second); ; {
+		select {
+		case res, ok := <-results:
+			if !ok {
+				t.Fatalf("stream closed before the change to '%s'", file)
+			}
+
+			if res.Err != nil {
+				t.Fatal(res.Err)
+			}
+
+			if res.File == unwanted {
+				t.Fatalf("got the change to '%s', which isn't watched", unwanted)
+			}
+
+			if res.File == file {
+				return
+			}
+
+		case <-timeout:
+			t.Fatalf("no result for '%s'", file)
+		}
+	}
+}
+
+func TestWatcherAddRemove(t *testing.T) {
+	w, dir := newTestWatcher(t, WatcherOptions{})
+	defer os.RemoveAll(dir) // nolint:errcheck
+	defer w.Close()         // nolint:errcheck
+
+	other, err := ioutil.TempDir("", "leaf-other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(other) // nolint:errcheck
+
+	other, err = filepath.EvalSymlinks(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results := w.Watch(ctx)
+
+	if err := w.Add(other); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{dir, other}
+	if dir > other {
+		want = []string{other, dir}
+	}
+	if got := w.WatchedPaths(); !reflect.DeepEqual(got, want) {
+		t.Errorf("watched %v, want %v", got, want)
+	}
+
+	added := filepath.Join(other, "a.go")
+	writeFile(t, added)
+	receive(t, results, added)
+
+	if err := w.Remove(other); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := w.WatchedPaths(); !reflect.DeepEqual(got, []string{dir}) {
+		t.Errorf("watched %v, want only %v", got, []string{dir})
+	}
+
+	// The change to the removed root isn't reported, while the
+	// change after it is.
+	removed := filepath.Join(other, "b.go")
+	writeFile(t, removed)
+
+	marker := filepath.Join(dir, "a.go")
+	writeFile(t, marker)
+	receiveWithout(t, results, marker, removed)
+
+	if err := w.Remove(other); err == nil {
+		t.Error("removed a root that isn't watched")
+	}
+}
+
+func TestWatcherRemoveNestedRoot(t *testing.T) {
+	w, dir := newTestWatcher(t, WatcherOptions{})
+	defer os.RemoveAll(dir) // nolint:errcheck
+	defer w.Close()         // nolint:errcheck
+
+	nested := filepath.Join(dir, "nested")
+	if err := os.Mkdir(nested, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results := w.Watch(ctx)
+
+	if err := w.Add(nested); err != nil {
+		t.Fatal(err)
+	}
+
+	// The nested root is still watched as a part of the outer
+	// one after it's removed.
+	if err := w.Remove(nested); err != nil {
+		t.Fatal(err)
+	}
+
+	inNested := filepath.Join(nested, "a.go")
+	writeFile(t, inNested)
+	receive(t, results, inNested)
+
+	// The nested root is still watched after the outer one is
+	// removed, while the rest of the outer one isn't.
+	if err := w.Add(nested); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := w.WatchedPaths(); !reflect.DeepEqual(got, []string{nested}) {
+		t.Errorf("watched %v, want only %v", got, []string{nested})
+	}
+
+	outside := filepath.Join(dir, "b.go")
+	writeFile(t, outside)
+
+	inNested = filepath.Join(nested, "b.go")
+	writeFile(t, inNested)
+	receiveWithout(t, results, inNested, outside)
+}